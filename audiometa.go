@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	// maxTagBytes caps how much of an ID3v2 tag is read, so large embedded
+	// artwork doesn't pull megabytes per episode. Text frames normally come
+	// before the artwork.
+	maxTagBytes = 512 << 10
+
+	// maxMoovBytes caps how much of an MP4 moov atom is read.
+	maxMoovBytes = 8 << 20
+)
+
+// AudioInfo holds the metadata embedded in an audio file.
+type AudioInfo struct {
+	Title    string
+	Artist   string
+	Album    string
+	Comment  string
+	Duration time.Duration
+}
+
+// objectReaderAt reads byte ranges of a stored object on demand, so metadata
+// can be parsed without downloading the whole file.
+type objectReaderAt struct {
+	ctx   context.Context
+	store ObjectStore
+	name  string
+	size  int64
+}
+
+func (r objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	length := int64(len(p))
+	if off+length > r.size {
+		length = r.size - off
+	}
+
+	reader, err := r.store.NewRangeReader(r.ctx, r.name, off, length)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	n, err := io.ReadFull(reader, p[:length])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// hasAudioMagic reports whether the first bytes of an audio file match the
+// format its extension claims, to catch files that were renamed or mislabeled.
+func hasAudioMagic(r io.ReaderAt, name string) bool {
+	head := make([]byte, 12)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	id3 := bytes.HasPrefix(head, []byte("ID3"))
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp3":
+		// An ID3v2 tag, or an MPEG audio frame sync.
+		return id3 || len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0
+	case ".aac":
+		// An ID3v2 tag, ADIF, or an ADTS frame sync.
+		return id3 || bytes.HasPrefix(head, []byte("ADIF")) ||
+			len(head) >= 2 && head[0] == 0xFF && head[1]&0xF6 == 0xF0
+	case ".m4a":
+		return len(head) >= 8 && string(head[4:8]) == "ftyp"
+	case ".flac":
+		return id3 || bytes.HasPrefix(head, []byte("fLaC"))
+	case ".ogg", ".opus":
+		return bytes.HasPrefix(head, []byte("OggS"))
+	case ".wav":
+		return len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WAVE"
+	}
+	return false
+}
+
+// readAudioInfo reads the embedded tags and duration of an audio file.
+// Unsupported formats return an empty AudioInfo.
+func readAudioInfo(r io.ReaderAt, size int64, name string) (AudioInfo, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp3":
+		info, audioStart, err := readID3(r, size)
+		if err != nil {
+			return info, err
+		}
+		info.Duration, err = mp3Duration(r, size, audioStart)
+		return info, err
+	case ".m4a":
+		return readMP4Info(r, size)
+	}
+	return AudioInfo{}, nil
+}
+
+// readID3 parses the text frames of an ID3v2.2, v2.3 or v2.4 tag at the
+// start of r. It also returns the offset at which the audio data begins.
+func readID3(r io.ReaderAt, size int64) (AudioInfo, int64, error) {
+	var info AudioInfo
+
+	var hdr [10]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return info, 0, fmt.Errorf("failed to read ID3 header: %w", err)
+	}
+	if string(hdr[:3]) != "ID3" {
+		return info, 0, nil
+	}
+
+	version, flags := hdr[3], hdr[5]
+	tagSize := int64(syncsafe(hdr[6:10]))
+	audioStart := 10 + tagSize
+	if flags&0x10 != 0 {
+		audioStart += 10 // footer
+	}
+	if version < 2 || version > 4 || flags&0x80 != 0 {
+		// Unknown version or unsynchronised tag; not worth supporting.
+		return info, audioStart, nil
+	}
+
+	tagSize = min(tagSize, maxTagBytes, size-10)
+	buf := make([]byte, tagSize)
+	n, err := r.ReadAt(buf, 10)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return info, 0, fmt.Errorf("failed to read ID3 tag: %w", err)
+	}
+	buf = buf[:n]
+
+	if flags&0x40 != 0 && version >= 3 && len(buf) >= 4 {
+		// Skip the extended header.
+		ext := int(binary.BigEndian.Uint32(buf)) + 4
+		if version == 4 {
+			ext = syncsafe(buf[:4])
+		}
+		if ext > len(buf) {
+			return info, audioStart, nil
+		}
+		buf = buf[ext:]
+	}
+
+	idLen, hdrLen := 4, 10
+	if version == 2 {
+		idLen, hdrLen = 3, 6
+	}
+
+	for len(buf) >= hdrLen && buf[0] != 0 {
+		id := string(buf[:idLen])
+		var frameSize int
+		switch version {
+		case 2:
+			frameSize = int(buf[3])<<16 | int(buf[4])<<8 | int(buf[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(buf[4:8]))
+		case 4:
+			frameSize = syncsafe(buf[4:8])
+		}
+		buf = buf[hdrLen:]
+		if frameSize > len(buf) {
+			break
+		}
+		data := buf[:frameSize]
+		buf = buf[frameSize:]
+
+		switch id {
+		case "TIT2", "TT2":
+			info.Title = id3Text(data)
+		case "TPE1", "TP1":
+			info.Artist = id3Text(data)
+		case "TALB", "TAL":
+			info.Album = id3Text(data)
+		case "COMM", "COM":
+			if info.Comment == "" {
+				info.Comment = id3Comment(data)
+			}
+		}
+	}
+
+	return info, audioStart, nil
+}
+
+// syncsafe decodes a 4-byte ID3 syncsafe integer.
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// id3Text decodes a text information frame, returning its first value.
+func id3Text(data []byte) string {
+	if len(data) < 1 {
+		return ""
+	}
+	s, _ := id3String(data[0], data[1:])
+	return strings.TrimSpace(s)
+}
+
+// id3Comment decodes a comment frame, skipping its language and short
+// content description.
+func id3Comment(data []byte) string {
+	if len(data) < 4 {
+		return ""
+	}
+	enc := data[0]
+	_, rest := id3String(enc, data[4:])
+	s, _ := id3String(enc, rest)
+	return strings.TrimSpace(s)
+}
+
+// id3String decodes a NUL-terminated string in the given ID3 text encoding
+// and returns it along with the bytes following the terminator.
+func id3String(enc byte, b []byte) (string, []byte) {
+	if enc == 1 || enc == 2 {
+		end := len(b)
+		rest := []byte(nil)
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				end, rest = i, b[i+2:]
+				break
+			}
+		}
+		return decodeUTF16(b[:end], enc == 2), rest
+	}
+
+	end := len(b)
+	rest := []byte(nil)
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		end, rest = i, b[i+1:]
+	}
+	if enc == 3 {
+		return string(b[:end]), rest
+	}
+
+	// ISO-8859-1 maps directly onto the first 256 code points.
+	runes := make([]rune, end)
+	for i, c := range b[:end] {
+		runes[i] = rune(c)
+	}
+	return string(runes), rest
+}
+
+// decodeUTF16 decodes UTF-16 text, honouring a byte order mark if present.
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if len(b) >= 2 {
+		switch {
+		case b[0] == 0xff && b[1] == 0xfe:
+			bigEndian, b = false, b[2:]
+		case b[0] == 0xfe && b[1] == 0xff:
+			bigEndian, b = true, b[2:]
+		}
+	}
+
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = binary.BigEndian.Uint16(b[2*i:])
+		} else {
+			units[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// readMP4Info reads the duration from an MP4 file's moov/mvhd atom and the
+// iTunes-style metadata list from its moov/udta/meta/ilst atom.
+func readMP4Info(r io.ReaderAt, size int64) (AudioInfo, error) {
+	var info AudioInfo
+
+	moov, err := readMP4Moov(r, size)
+	if err != nil {
+		return info, err
+	}
+
+	info.Duration = mp4Duration(mp4Child(moov, "mvhd"))
+
+	meta := mp4Child(mp4Child(moov, "udta"), "meta")
+	if len(meta) < 4 {
+		return info, nil
+	}
+	// meta is a full box: skip its version and flags.
+	ilst := mp4Child(meta[4:], "ilst")
+
+	info.Title = mp4Text(mp4Child(ilst, "\xa9nam"))
+	info.Artist = mp4Text(mp4Child(ilst, "\xa9ART"))
+	info.Album = mp4Text(mp4Child(ilst, "\xa9alb"))
+	info.Comment = mp4Text(mp4Child(ilst, "desc"))
+	if info.Comment == "" {
+		info.Comment = mp4Text(mp4Child(ilst, "\xa9cmt"))
+	}
+
+	return info, nil
+}
+
+// readMP4Moov locates the top-level moov atom and returns its body.
+func readMP4Moov(r io.ReaderAt, size int64) ([]byte, error) {
+	var hdr [16]byte
+	for pos := int64(0); pos+8 <= size; {
+		if _, err := r.ReadAt(hdr[:8], pos); err != nil {
+			return nil, fmt.Errorf("failed to read MP4 atom header: %w", err)
+		}
+
+		atomSize, hdrLen := int64(binary.BigEndian.Uint32(hdr[:4])), int64(8)
+		switch atomSize {
+		case 0:
+			atomSize = size - pos
+		case 1:
+			if _, err := r.ReadAt(hdr[8:16], pos+8); err != nil {
+				return nil, fmt.Errorf("failed to read MP4 atom header: %w", err)
+			}
+			atomSize, hdrLen = int64(binary.BigEndian.Uint64(hdr[8:16])), 16
+		}
+		if atomSize < hdrLen {
+			return nil, errors.New("invalid MP4 atom size")
+		}
+
+		if string(hdr[4:8]) == "moov" {
+			bodyLen := atomSize - hdrLen
+			if bodyLen > maxMoovBytes {
+				return nil, fmt.Errorf("MP4 moov atom too large (%d bytes)", bodyLen)
+			}
+			body := make([]byte, bodyLen)
+			if _, err := r.ReadAt(body, pos+hdrLen); err != nil {
+				return nil, fmt.Errorf("failed to read MP4 moov atom: %w", err)
+			}
+			return body, nil
+		}
+
+		pos += atomSize
+	}
+	return nil, errors.New("MP4 moov atom not found")
+}
+
+// mp4Child returns the body of the first child atom of type typ in b, or nil
+// if there is none.
+func mp4Child(b []byte, typ string) []byte {
+	for len(b) >= 8 {
+		atomSize, hdrLen := int(binary.BigEndian.Uint32(b)), 8
+		switch atomSize {
+		case 0:
+			atomSize = len(b)
+		case 1:
+			if len(b) < 16 {
+				return nil
+			}
+			atomSize, hdrLen = int(binary.BigEndian.Uint64(b[8:16])), 16
+		}
+		if atomSize < hdrLen || atomSize > len(b) {
+			return nil
+		}
+		if string(b[4:8]) == typ {
+			return b[hdrLen:atomSize]
+		}
+		b = b[atomSize:]
+	}
+	return nil
+}
+
+// mp4Text returns the string value of an ilst item's data atom.
+func mp4Text(item []byte) string {
+	data := mp4Child(item, "data")
+	if len(data) < 8 {
+		return ""
+	}
+	// Skip the 4-byte type indicator and 4-byte locale.
+	return strings.TrimSpace(string(data[8:]))
+}
+
+// mp4Duration returns the movie duration recorded in an mvhd atom body.
+func mp4Duration(mvhd []byte) time.Duration {
+	var timescale, duration uint64
+	switch {
+	case len(mvhd) >= 20 && mvhd[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	case len(mvhd) >= 32 && mvhd[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:24]))
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	}
+	if timescale == 0 {
+		return 0
+	}
+	// Multiplying by time.Second first would overflow for long files.
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+}
+
+// mp3Bitrates holds the MPEG audio layer III bitrates in kbps, indexed by
+// bitrate index, for MPEG-1 and for MPEG-2/2.5.
+var mp3Bitrates = [2][16]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+// mp3SampleRates holds the sample rates in Hz, indexed by MPEG version bits
+// and sample rate index.
+var mp3SampleRates = [4][3]int{
+	{11025, 12000, 8000},  // MPEG-2.5
+	{0, 0, 0},             // reserved
+	{22050, 24000, 16000}, // MPEG-2
+	{44100, 48000, 32000}, // MPEG-1
+}
+
+// mp3Duration estimates the duration of an MPEG layer III stream starting at
+// audioStart. It uses the frame count from a Xing/Info or VBRI header when
+// the first frame has one, and otherwise assumes a constant bitrate.
+func mp3Duration(r io.ReaderAt, size, audioStart int64) (time.Duration, error) {
+	buf := make([]byte, 4096)
+	n, err := r.ReadAt(buf, audioStart)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, fmt.Errorf("failed to read MP3 frames: %w", err)
+	}
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xff || buf[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+		version := buf[i+1] >> 3 & 0x3
+		layer := buf[i+1] >> 1 & 0x3
+		bitrateIdx := buf[i+2] >> 4
+		rateIdx := buf[i+2] >> 2 & 0x3
+		if version == 1 || layer != 1 || bitrateIdx == 0 || bitrateIdx == 15 || rateIdx == 3 {
+			// Not a valid layer III frame header; keep scanning.
+			continue
+		}
+
+		mpeg1 := version == 3
+		mono := buf[i+3]>>6 == 3
+		sampleRate := mp3SampleRates[version][rateIdx]
+		samplesPerFrame := 1152
+		bitrate := mp3Bitrates[1][bitrateIdx]
+		if mpeg1 {
+			bitrate = mp3Bitrates[0][bitrateIdx]
+		} else {
+			samplesPerFrame = 576
+		}
+
+		frame := buf[i:]
+		sideInfo := 32
+		switch {
+		case mpeg1 && mono:
+			sideInfo = 17
+		case !mpeg1 && !mono:
+			sideInfo = 17
+		case !mpeg1 && mono:
+			sideInfo = 9
+		}
+
+		var frames uint32
+		if x := 4 + sideInfo; len(frame) >= x+12 {
+			if tag := string(frame[x : x+4]); (tag == "Xing" || tag == "Info") && frame[x+7]&0x1 != 0 {
+				frames = binary.BigEndian.Uint32(frame[x+8 : x+12])
+			}
+		}
+		if v := 4 + 32; frames == 0 && len(frame) >= v+18 && string(frame[v:v+4]) == "VBRI" {
+			frames = binary.BigEndian.Uint32(frame[v+14 : v+18])
+		}
+
+		if frames > 0 {
+			return time.Duration(float64(frames) * float64(samplesPerFrame) / float64(sampleRate) * float64(time.Second)), nil
+		}
+		audioBytes := size - audioStart - int64(i)
+		return time.Duration(float64(audioBytes*8) / float64(bitrate*1000) * float64(time.Second)), nil
+	}
+
+	return 0, nil
+}
+
+// formatDuration renders d as HH:MM:SS for <itunes:duration>.
+func formatDuration(d time.Duration) string {
+	secs := int64(d.Round(time.Second) / time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+}
@@ -0,0 +1,22 @@
+package main
+
+import "time"
+
+// Clock tells the time and waits for it to pass. Logic whose outcome depends
+// on the current time, such as cache expiry, signed URL lifetimes and retry
+// delays, goes through clock rather than the time package, so it can be
+// given a fixed time.
+type Clock interface {
+	Now() time.Time
+	// After returns a channel that receives once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clock is the Clock used by the service.
+var clock Clock = realClock{}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves when it is waited on. After
+// returns at once, advancing the time by the wait and recording it.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.waits = append(c.waits, d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// useFakeClock replaces clock with a fakeClock set to now for the duration
+// of the test.
+func useFakeClock(t *testing.T, now time.Time) *fakeClock {
+	t.Helper()
+	fake := &fakeClock{now: now}
+	old := clock
+	clock = fake
+	t.Cleanup(func() { clock = old })
+	return fake
+}
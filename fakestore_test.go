@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeStore is an in-memory ObjectStore. Generations and preconditions
+// behave as in GCS, so conditional writes can lose races.
+type fakeStore struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	gen     int64
+
+	// fail, if set, is called before each operation with the method name,
+	// such as "Write", and the object name; for Copy it is the destination
+	// and for List the prefix. An error it returns fails the operation,
+	// which then has no effect.
+	fail func(op, name string) error
+	// written lists the objects created by Write and Copy, in order.
+	written []string
+}
+
+type fakeObject struct {
+	content []byte
+	attrs   storage.ObjectAttrs
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{objects: make(map[string]*fakeObject)}
+}
+
+// put stores an object with the given content, as if uploaded now. attrs,
+// if given, supplies fields such as ContentType and Metadata.
+func (s *fakeStore) put(name string, content []byte, attrs *storage.ObjectAttrs) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var a storage.ObjectAttrs
+	if attrs != nil {
+		a = *attrs
+	}
+	s.store(name, content, a)
+}
+
+// store saves an object as a new generation. s.mu must be held.
+func (s *fakeStore) store(name string, content []byte, attrs storage.ObjectAttrs) {
+	s.gen++
+	now := time.Now()
+	attrs.Name = name
+	attrs.Size = int64(len(content))
+	attrs.Generation = s.gen
+	attrs.Created = now
+	attrs.Updated = now
+	s.objects[name] = &fakeObject{content: bytes.Clone(content), attrs: attrs}
+}
+
+// content returns the content of an object, or "" if it doesn't exist.
+func (s *fakeStore) content(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if obj, ok := s.objects[name]; ok {
+		return string(obj.content)
+	}
+	return ""
+}
+
+// names returns the names of every object, sorted.
+func (s *fakeStore) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// injected returns the error fail gives for op on object name, if any.
+func (s *fakeStore) injected(op, name string) error {
+	if s.fail == nil {
+		return nil
+	}
+	return s.fail(op, name)
+}
+
+// writes returns how many times object name was written by Write or Copy.
+func (s *fakeStore) writes(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, w := range s.written {
+		if w == name {
+			n++
+		}
+	}
+	return n
+}
+
+// check returns the error GCS gives when cond doesn't hold for object name.
+// s.mu must be held.
+func (s *fakeStore) check(name string, cond storage.Conditions) error {
+	obj, exists := s.objects[name]
+	if (cond.DoesNotExist && exists) ||
+		(cond.GenerationMatch != 0 && (!exists || obj.attrs.Generation != cond.GenerationMatch)) {
+		return &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "conditionNotMet"}
+	}
+	return nil
+}
+
+func (s *fakeStore) Read(ctx context.Context, name string) ([]byte, *storage.ObjectAttrs, error) {
+	if err := s.injected("Read", name); err != nil {
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[name]
+	if !ok {
+		return nil, nil, storage.ErrObjectNotExist
+	}
+	attrs := obj.attrs
+	return bytes.Clone(obj.content), &attrs, nil
+}
+
+func (s *fakeStore) NewRangeReader(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if err := s.injected("NewRangeReader", name); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[name]
+	if !ok {
+		return nil, storage.ErrObjectNotExist
+	}
+	content := obj.content[min(offset, int64(len(obj.content))):]
+	if length >= 0 && length < int64(len(content)) {
+		content = content[:length]
+	}
+	return io.NopCloser(bytes.NewReader(bytes.Clone(content))), nil
+}
+
+func (s *fakeStore) Write(ctx context.Context, name, contentType string, content []byte, cond storage.Conditions) error {
+	if err := s.injected("Write", name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(name, cond); err != nil {
+		return err
+	}
+	s.store(name, content, storage.ObjectAttrs{ContentType: contentType})
+	s.written = append(s.written, name)
+	return nil
+}
+
+func (s *fakeStore) NewWriter(ctx context.Context, name, contentType string, cond storage.Conditions) (io.WriteCloser, error) {
+	if err := s.injected("NewWriter", name); err != nil {
+		return nil, err
+	}
+	return &fakeWriter{store: s, ctx: ctx, name: name, contentType: contentType, cond: cond}, nil
+}
+
+// fakeWriter buffers what is written to it and stores it with Write when it
+// is closed, unless its context is done by then.
+type fakeWriter struct {
+	bytes.Buffer
+	store       *fakeStore
+	ctx         context.Context
+	name        string
+	contentType string
+	cond        storage.Conditions
+}
+
+func (w *fakeWriter) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	return w.store.Write(w.ctx, w.name, w.contentType, w.Bytes(), w.cond)
+}
+
+func (s *fakeStore) Copy(ctx context.Context, src, dst string, cond storage.Conditions) error {
+	if err := s.injected("Copy", dst); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[src]
+	if !ok {
+		return storage.ErrObjectNotExist
+	}
+	if err := s.check(dst, cond); err != nil {
+		return err
+	}
+	s.store(dst, obj.content, obj.attrs)
+	s.written = append(s.written, dst)
+	return nil
+}
+
+func (s *fakeStore) Delete(ctx context.Context, name string) error {
+	if err := s.injected("Delete", name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[name]; !ok {
+		return storage.ErrObjectNotExist
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *fakeStore) Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	if err := s.injected("Attrs", name); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[name]
+	if !ok {
+		return nil, storage.ErrObjectNotExist
+	}
+	attrs := obj.attrs
+	return &attrs, nil
+}
+
+func (s *fakeStore) List(ctx context.Context, prefix string) ([]*storage.ObjectAttrs, error) {
+	if err := s.injected("List", prefix); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var objects []*storage.ObjectAttrs
+	for name, obj := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			attrs := obj.attrs
+			objects = append(objects, &attrs)
+		}
+	}
+	slices.SortFunc(objects, func(a, b *storage.ObjectAttrs) int { return strings.Compare(a.Name, b.Name) })
+	return objects, nil
+}
+
+func (s *fakeStore) SignedURL(name string, opts *storage.SignedURLOptions) (string, error) {
+	if err := s.injected("SignedURL", name); err != nil {
+		return "", err
+	}
+	return "https://storage.example.com/" + name + "?signed", nil
+}
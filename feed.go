@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	itunesNamespace  = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	atomNamespace    = "http://www.w3.org/2005/Atom"
+	podcastNamespace = "https://podcastindex.org/namespace/1.0"
+)
+
+// RSS is the root element of the podcast feed.
+type RSS struct {
+	XMLName   xml.Name `xml:"rss"`
+	Version   string   `xml:"version,attr"`
+	ITunesNS  string   `xml:"xmlns:itunes,attr,omitempty"`
+	AtomNS    string   `xml:"xmlns:atom,attr,omitempty"`
+	PodcastNS string   `xml:"xmlns:podcast,attr,omitempty"`
+	Channel   Channel  `xml:"channel"`
+
+	// archives are the archive page objects the feed was read from, which
+	// are deleted once it has been written back.
+	archives []string
+}
+
+// Channel holds the feed-level metadata and its episodes.
+type Channel struct {
+	Title          string          `xml:"title,omitempty"`
+	Link           string          `xml:"link,omitempty"`
+	Description    string          `xml:"description,omitempty"`
+	Language       string          `xml:"language,omitempty"`
+	Image          *Image          `xml:"image"`
+	ITunesAuthor   string          `xml:"itunes:author,omitempty"`
+	ITunesImage    *ITunesImage    `xml:"itunes:image"`
+	ITunesCategory *ITunesCategory `xml:"itunes:category"`
+	ITunesExplicit string          `xml:"itunes:explicit,omitempty"`
+	PubDate        string          `xml:"pubDate,omitempty"`
+	AtomLinks      []AtomLink      `xml:"atom:link"`
+	Items          []Item          `xml:"item"`
+}
+
+// AtomLink relates the feed to other documents, such as the next page of a
+// paged feed.
+type AtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+// Image is the standard RSS channel image.
+type Image struct {
+	URL   string `xml:"url"`
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+}
+
+// ITunesImage is the podcast artwork shown by Apple Podcasts.
+type ITunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+// ITunesCategory is the Apple Podcasts category of the show.
+type ITunesCategory struct {
+	Text string `xml:"text,attr"`
+}
+
+// Item is a single podcast episode. Elements are written in field order;
+// title, pubDate, guid, enclosure, description is the order validators
+// expect, so keep new fields after them.
+type Item struct {
+	Title          string       `xml:"title"`
+	PubDate        string       `xml:"pubDate"`
+	GUID           GUID         `xml:"guid"`
+	Enclosure      Enclosure    `xml:"enclosure"`
+	Description    *CDATA       `xml:"description"`
+	ITunesSummary  *CDATA       `xml:"itunes:summary"`
+	ITunesAuthor   string       `xml:"itunes:author,omitempty"`
+	ITunesDuration string       `xml:"itunes:duration,omitempty"`
+	ITunesImage    *ITunesImage `xml:"itunes:image"`
+	ITunesExplicit string       `xml:"itunes:explicit,omitempty"`
+	ITunesSeason   int          `xml:"itunes:season,omitempty"`
+	ITunesEpisode  int          `xml:"itunes:episode,omitempty"`
+	ITunesKeywords string       `xml:"itunes:keywords,omitempty"`
+	Transcript     *Transcript  `xml:"podcast:transcript"`
+	Chapters       *Chapters    `xml:"podcast:chapters"`
+	Extra          []XMLElement `xml:",any"` // from ITEM_TEMPLATE
+}
+
+// GUID uniquely identifies an episode so clients don't re-download it when
+// the feed is rewritten.
+type GUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// Transcript links an episode to its transcript, per the Podcasting 2.0
+// namespace.
+type Transcript struct {
+	URL  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
+
+// Chapters links an episode to its JSON chapters file, per the Podcasting
+// 2.0 namespace.
+type Chapters struct {
+	URL  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
+
+// XMLElement is an arbitrary element kept in an item as it is, such as one
+// added by ITEM_TEMPLATE. Text mixed with child elements isn't kept in order.
+type XMLElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr   `xml:",any,attr"`
+	Text     string       `xml:",chardata"`
+	Children []XMLElement `xml:",any"`
+}
+
+// UnmarshalXML decodes the element, dropping whitespace-only text so the
+// indentation written by marshal doesn't accumulate on each update.
+func (e *XMLElement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain XMLElement
+	if err := d.DecodeElement((*plain)(e), &start); err != nil {
+		return err
+	}
+	if strings.TrimSpace(e.Text) == "" {
+		e.Text = ""
+	}
+	return nil
+}
+
+// CDATA is element text written as a CDATA section, so HTML in episode
+// descriptions doesn't need escaping.
+type CDATA struct {
+	Text string `xml:",cdata"`
+}
+
+// Enclosure points at the episode's audio file.
+type Enclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// newFeed returns an empty feed used when no index.xml exists yet.
+func newFeed() *RSS {
+	return &RSS{Version: "2.0", ITunesNS: itunesNamespace}
+}
+
+// fileURL returns the public URL for a files bucket object under
+// ENCLOSURE_BASE_URL. FILES_PREFIX is stripped from the name, which is then
+// escaped as a single path segment.
+func fileURL(objectName string) string {
+	name := strings.TrimPrefix(objectName, filesPrefix)
+	return strings.TrimSuffix(enclosureBaseURL, "/") + "/" + url.PathEscape(name)
+}
+
+// formatPubDate formats t as an RFC 822 date with a four-digit year and a
+// numeric zone, the form podcast validators require for pubDate.
+func formatPubDate(t time.Time) string {
+	return t.Format(time.RFC1123Z)
+}
+
+// guidFor returns the GUID for a files bucket object. It depends only on the
+// object name, so reprocessing the same file always yields the same GUID.
+func guidFor(objectName string) GUID {
+	return GUID{Value: objectName}
+}
+
+// findItem returns the index of the item for objectName, or -1 if there is
+// none. Items are matched on GUID, or on enclosure URL for items written
+// before GUIDs were object names.
+func (c *Channel) findItem(objectName string) int {
+	guid := guidFor(objectName)
+	enclosure := fileURL(objectName)
+	for i, item := range c.Items {
+		if item.GUID.Value == guid.Value || item.Enclosure.URL == enclosure {
+			return i
+		}
+	}
+	return -1
+}
+
+// pubDateLayouts are the layouts accepted when parsing an item's pubDate. The
+// last one is the format written by earlier versions of this service.
+var pubDateLayouts = []string{time.RFC1123Z, time.RFC1123, "Mon 02 Jan 2006 03:04:05 PM MST"}
+
+// pubTime returns the item's parsed pubDate, or the zero time if it can't be
+// parsed.
+func (i Item) pubTime() time.Time {
+	for _, layout := range pubDateLayouts {
+		if t, err := time.Parse(layout, i.PubDate); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dedupeItems drops items that share a GUID with a newer item, by pubDate.
+// Items without a GUID are keyed on their enclosure URL. The order of the
+// surviving items is kept.
+func dedupeItems(items []Item) []Item {
+	key := func(item Item) string {
+		if item.GUID.Value != "" {
+			return item.GUID.Value
+		}
+		return item.Enclosure.URL
+	}
+
+	newest := make(map[string]int, len(items))
+	for i, item := range items {
+		j, seen := newest[key(item)]
+		if !seen || item.pubTime().After(items[j].pubTime()) {
+			newest[key(item)] = i
+		}
+	}
+
+	deduped := make([]Item, 0, len(newest))
+	for i, item := range items {
+		if newest[key(item)] == i {
+			deduped = append(deduped, item)
+		}
+	}
+	return deduped
+}
+
+// sortItems orders items newest first, breaking ties on the enclosure URL so
+// the output is deterministic.
+func (c *Channel) sortItems() {
+	sort.SliceStable(c.Items, func(i, j int) bool {
+		ti, tj := c.Items[i].pubTime(), c.Items[j].pubTime()
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return c.Items[i].Enclosure.URL < c.Items[j].Enclosure.URL
+	})
+}
+
+// hasLink reports whether the channel has an atom:link with relation rel.
+func (c *Channel) hasLink(rel string) bool {
+	for _, link := range c.AtomLinks {
+		if link.Rel == rel {
+			return true
+		}
+	}
+	return false
+}
+
+// removeLinks drops any atom:link whose relation is one of rels.
+func (c *Channel) removeLinks(rels ...string) {
+	links := c.AtomLinks[:0]
+	for _, link := range c.AtomLinks {
+		if !slices.Contains(rels, link.Rel) {
+			links = append(links, link)
+		}
+	}
+	c.AtomLinks = links
+}
+
+// paginate splits the feed into pages of at most perPage items that share
+// the channel metadata, linked to each other with rel="next" and rel="prev"
+// atom:links. pageURL returns the public URL of page n, counting from 1; a
+// rel="self" link on later pages is pointed at it. A perPage of 0 or less
+// returns the feed as a single page.
+func (f *RSS) paginate(perPage int, pageURL func(n int) string) []*RSS {
+	items := f.Channel.Items
+	if perPage <= 0 || len(items) <= perPage {
+		return []*RSS{f}
+	}
+
+	var pages []*RSS
+	for n := 1; len(items) > 0; n++ {
+		page := *f
+		page.Channel.AtomLinks = slices.Clone(f.Channel.AtomLinks)
+		page.Channel.Items = items[:min(perPage, len(items))]
+		items = items[len(page.Channel.Items):]
+
+		if n > 1 && page.Channel.hasLink("self") {
+			page.Channel.removeLinks("self")
+			page.Channel.AtomLinks = append(page.Channel.AtomLinks, AtomLink{Href: pageURL(n), Rel: "self", Type: "application/rss+xml"})
+		}
+		if n > 1 {
+			page.Channel.AtomLinks = append(page.Channel.AtomLinks, AtomLink{Href: pageURL(n - 1), Rel: "prev", Type: "application/rss+xml"})
+		}
+		if len(items) > 0 {
+			page.Channel.AtomLinks = append(page.Channel.AtomLinks, AtomLink{Href: pageURL(n + 1), Rel: "next", Type: "application/rss+xml"})
+		}
+		pages = append(pages, &page)
+	}
+	return pages
+}
+
+// parseFeed decodes an RSS document into an RSS struct.
+func parseFeed(content string) (*RSS, error) {
+	return decodeFeed(strings.NewReader(content))
+}
+
+// decodeFeed decodes an RSS document from r, token by token, so the caller
+// needn't hold the document as a string as well as the parsed feed.
+func decodeFeed(r io.Reader) (*RSS, error) {
+	var feed RSS
+	d := xml.NewTokenDecoder(prefixedTokenReader{xml.NewDecoder(r)})
+	if err := d.Decode(&feed); err != nil {
+		return nil, fmt.Errorf("failed to parse feed: %w", err)
+	}
+	return &feed, nil
+}
+
+// validateFeed parses a rendered feed document and checks it has the
+// elements podcast clients need: the rss version, a channel title and an
+// enclosure URL and type on every item.
+func validateFeed(content string) error {
+	_, err := checkFeed(strings.NewReader(content))
+	return err
+}
+
+// checkFeed reads a feed document from r and checks it as validateFeed
+// does. Items are decoded and checked one at a time, so neither the
+// document nor the parsed feed is held in memory as a whole. It returns the
+// channel, without its items.
+func checkFeed(r io.Reader) (*Channel, error) {
+	var doc struct {
+		XMLName xml.Name `xml:"rss"`
+		Version string   `xml:"version,attr"`
+		Channel struct {
+			Channel
+			Items itemChecker `xml:"item"` // in place of Channel.Items
+		} `xml:"channel"`
+	}
+	d := xml.NewTokenDecoder(prefixedTokenReader{xml.NewDecoder(r)})
+	if err := d.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse feed: %w", err)
+	}
+	if doc.Version == "" {
+		return nil, errors.New("rss element has no version")
+	}
+	if doc.Channel.Title == "" {
+		return nil, errors.New("channel has no title")
+	}
+	if err := doc.Channel.Items.err; err != nil {
+		return nil, err
+	}
+	return &doc.Channel.Channel, nil
+}
+
+// itemChecker checks every item decoded into it for a complete enclosure,
+// keeping only the first problem found.
+type itemChecker struct {
+	n   int
+	err error
+}
+
+func (c *itemChecker) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var item Item
+	if err := d.DecodeElement(&item, &start); err != nil {
+		return err
+	}
+	if c.err == nil && (item.Enclosure.URL == "" || item.Enclosure.Type == "") {
+		c.err = fmt.Errorf("item %d (%q) has an incomplete enclosure", c.n, item.Title)
+	}
+	c.n++
+	return nil
+}
+
+// marshal encodes the feed as a complete XML document.
+func (f *RSS) marshal() (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		return "", fmt.Errorf("failed to encode feed: %w", err)
+	}
+	buf.WriteString("\n")
+
+	return buf.String(), nil
+}
+
+// prefixedTokenReader passes raw tokens through with any namespace prefix kept
+// as part of the local name, so that struct tags like "itunes:author" match on
+// decode the same way they are written on encode.
+type prefixedTokenReader struct {
+	d *xml.Decoder
+}
+
+func (r prefixedTokenReader) Token() (xml.Token, error) {
+	tok, err := r.d.RawToken()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case xml.StartElement:
+		t.Name = prefixedName(t.Name)
+		attrs := make([]xml.Attr, len(t.Attr))
+		for i, a := range t.Attr {
+			attrs[i] = xml.Attr{Name: prefixedName(a.Name), Value: a.Value}
+		}
+		t.Attr = attrs
+		return t, nil
+	case xml.EndElement:
+		t.Name = prefixedName(t.Name)
+		return t, nil
+	}
+	return xml.CopyToken(tok), nil
+}
+
+func prefixedName(n xml.Name) xml.Name {
+	if n.Space == "" {
+		return n
+	}
+	return xml.Name{Local: n.Space + ":" + n.Local}
+}
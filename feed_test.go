@@ -0,0 +1,107 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc822Date matches the dates accepted by the RSS validators used by
+// Apple Podcasts.
+var rfc822Date = regexp.MustCompile(`^(?:(?:Mon|Tue|Wed|Thu|Fri|Sat|Sun), *)?\d\d? +(?:Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec) +\d\d(?:\d\d)? +\d\d:\d\d(?::\d\d)? +(?:[+-]\d{4}|UT|GMT|EST|EDT|CST|CDT|MST|MDT|PST|PDT|[A-IK-Z])$`)
+
+func TestFormatPubDate(t *testing.T) {
+	tests := []time.Time{
+		time.Date(2024, 5, 1, 9, 5, 0, 0, time.UTC),
+		time.Date(2024, 12, 31, 23, 59, 59, 0, time.FixedZone("", -7*60*60)),
+		time.Date(2025, 1, 1, 0, 0, 0, 0, time.FixedZone("IST", 5*60*60+30*60)),
+	}
+	for _, tt := range tests {
+		got := formatPubDate(tt)
+		if !rfc822Date.MatchString(got) {
+			t.Errorf("formatPubDate(%v) = %q, not an RFC 822 date", tt, got)
+		}
+		if parsed, err := time.Parse(time.RFC1123Z, got); err != nil || !parsed.Equal(tt) {
+			t.Errorf("formatPubDate(%v) = %q, which parses as %v, %v", tt, got, parsed, err)
+		}
+	}
+
+	// The layout used before this change isn't accepted.
+	if old := tests[0].Format("Mon 02 Jan 2006 03:04:05 PM MST"); rfc822Date.MatchString(old) {
+		t.Errorf("rfc822Date matches %q", old)
+	}
+}
+
+func TestDescriptionCDATA(t *testing.T) {
+	const description = "<p>Links: <a href=\"https://example.com/?a=1&b=2\">show notes</a></p> ]]> end"
+
+	feed := newFeed()
+	feed.Channel.Items = []Item{{
+		Title:         "Episode 1",
+		GUID:          guidFor("ep1.mp3"),
+		Enclosure:     Enclosure{URL: fileURL("ep1.mp3"), Length: 1, Type: "audio/mpeg"},
+		Description:   &CDATA{Text: description},
+		ITunesSummary: &CDATA{Text: description},
+	}}
+	content, err := feed.marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if !strings.Contains(content, "<description><![CDATA[<p>Links:") {
+		t.Errorf("description isn't written as CDATA:\n%s", content)
+	}
+
+	parsed, err := parseFeed(content)
+	if err != nil {
+		t.Fatalf("parseFeed: %v\n%s", err, content)
+	}
+	item := parsed.Channel.Items[0]
+	if item.Description == nil || item.Description.Text != description {
+		t.Errorf("description = %+v, want %q", item.Description, description)
+	}
+	if item.ITunesSummary == nil || item.ITunesSummary.Text != description {
+		t.Errorf("itunes:summary = %+v, want %q", item.ITunesSummary, description)
+	}
+}
+
+func TestValidateFeed(t *testing.T) {
+	valid := string(renderTestFeed(t, testItem(1)))
+	noType := testItem(2)
+	noType.Enclosure.Type = ""
+	noURL := testItem(2)
+	noURL.Enclosure.URL = ""
+	incompleteType := string(renderTestFeed(t, testItem(1), noType))
+	incompleteURL := string(renderTestFeed(t, noURL))
+	setForTest(t, &shows[0].Title, "")
+	untitled := string(renderTestFeed(t, testItem(1)))
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string // "" for a valid feed
+	}{
+		{"valid", valid, ""},
+		{"no version", strings.Replace(valid, ` version="2.0"`, "", 1), "no version"},
+		{"no channel title", untitled, "no title"},
+		{"enclosure without type", incompleteType, `item 0 ("Episode 2") has an incomplete enclosure`},
+		{"enclosure without URL", incompleteURL, "incomplete enclosure"},
+		{"not rss", `<feed xmlns="http://www.w3.org/2005/Atom"></feed>`, "failed to parse"},
+		{"truncated", valid[:len(valid)/2], "failed to parse"},
+		{"not XML", "not a feed", "failed to parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFeed(tt.content)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateFeed = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateFeed = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+
+	"cloud.google.com/go/storage"
+)
+
+// errCannotStream is returned when an item can't be inserted into the feed
+// as it streams past, and the feed has to be updated by parsing it in full.
+var errCannotStream = errors.New("item can't be inserted by streaming")
+
+// itemIndent is the indentation of an item element in a rendered feed.
+const itemIndent = "    "
+
+// insertItem copies the feed document read from r to w token by token, with
+// item added as the first item of the channel and any existing item for the
+// same GUID or enclosure URL dropped. Only one item is decoded at a time, so
+// neither the document nor the parsed feed is held in memory as a whole.
+//
+// It returns errCannotStream if the result would differ from a full update:
+// when the channel links to archive pages, when an existing item is newer
+// than item and so belongs before it, or when the rss element doesn't
+// declare the namespaces item may use.
+func insertItem(w io.Writer, r io.Reader, item Item) error {
+	dec := xml.NewTokenDecoder(prefixedTokenReader{xml.NewDecoder(r)})
+	enc := xml.NewEncoder(w)
+	pubTime := item.pubTime()
+
+	// writeItem writes it at the current position, indented the way
+	// renderFeed indents items. Items are encoded one at a time into a
+	// reused buffer.
+	var itemBuf bytes.Buffer
+	itemEnc := xml.NewEncoder(&itemBuf)
+	itemEnc.Indent(itemIndent, "  ")
+	writeItem := func(it Item) error {
+		itemBuf.Reset()
+		if err := itemEnc.EncodeElement(it, xml.StartElement{Name: xml.Name{Local: "item"}}); err != nil {
+			return fmt.Errorf("failed to encode item: %w", err)
+		}
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+		_, err := w.Write(bytes.TrimLeft(itemBuf.Bytes(), "\n "))
+		return err
+	}
+
+	// Whitespace between the channel's children is held back until the
+	// next child is seen, so it can be dropped along with an item.
+	var space xml.CharData
+	inserted := false
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse feed: %w", err)
+		}
+
+		if depth == 2 {
+			if t, ok := tok.(xml.CharData); ok && len(bytes.TrimSpace(t)) == 0 {
+				space = t.Copy()
+				continue
+			}
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 && !declaresItemNamespaces(t) {
+				return errCannotStream
+			}
+			if depth == 2 && t.Name.Local == "atom:link" && attrValue(t, "rel") == "next" {
+				return errCannotStream
+			}
+			if depth == 2 && t.Name.Local == "item" {
+				var existing Item
+				if err := dec.DecodeElement(&existing, &t); err != nil {
+					return fmt.Errorf("failed to parse feed: %w", err)
+				}
+				if existing.GUID.Value == item.GUID.Value || existing.Enclosure.URL == item.Enclosure.URL {
+					space = nil
+					continue
+				}
+				if pubTime.Before(existing.pubTime()) {
+					return errCannotStream
+				}
+				if !inserted {
+					if err := enc.EncodeToken(space); err != nil {
+						return err
+					}
+					if err := writeItem(item); err != nil {
+						return err
+					}
+					inserted = true
+				}
+				if err := enc.EncodeToken(space); err != nil {
+					return err
+				}
+				space = nil
+				if err := writeItem(existing); err != nil {
+					return err
+				}
+				continue
+			}
+			depth++
+		case xml.EndElement:
+			if depth == 2 && t.Name.Local == "channel" && !inserted {
+				if err := enc.EncodeToken(xml.CharData("\n" + itemIndent)); err != nil {
+					return err
+				}
+				if err := writeItem(item); err != nil {
+					return err
+				}
+				inserted = true
+			}
+			depth--
+		}
+
+		if space != nil {
+			if err := enc.EncodeToken(space); err != nil {
+				return err
+			}
+			space = nil
+		}
+		if err := enc.EncodeToken(tok); err != nil {
+			return fmt.Errorf("failed to encode feed: %w", err)
+		}
+	}
+
+	if !inserted {
+		return errors.New("feed has no channel")
+	}
+	return enc.Flush()
+}
+
+// declaresItemNamespaces reports whether an rss start element declares the
+// prefixes used by the elements of an Item.
+func declaresItemNamespaces(rss xml.StartElement) bool {
+	return rss.Name.Local == "rss" &&
+		attrValue(rss, "xmlns:itunes") == itunesNamespace &&
+		attrValue(rss, "xmlns:podcast") == podcastNamespace
+}
+
+// attrValue returns the value of the attribute called name, or "".
+func attrValue(start xml.StartElement, name string) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// streamItem adds item to the top of the show's index.xml with insertItem,
+// streaming the document from index.xml into a temporary object rather
+// than parsing all of it. The temporary object is read back and checked
+// with checkFeed before it is copied over index.xml, conditional on the
+// generation that was read. It returns errCannotStream when the feed has to
+// be updated in full instead: when it is paginated, doesn't exist yet or
+// can't be parsed, when insertItem can't place the item, when the result
+// fails the check or its channel metadata differs from the configured
+// metadata, or when index.xml changes during the update.
+func streamItem(ctx context.Context, show *Show, item Item) error {
+	if feedMaxItems > 0 {
+		return errCannotStream
+	}
+
+	attrs, err := indexStore.Attrs(ctx, show.IndexObject)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return errCannotStream
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", show.IndexObject, err)
+	}
+
+	// Should the object change after Attrs, the conditional copy below
+	// fails, so the content read here can't be lost.
+	r, err := indexStore.NewRangeReader(ctx, show.IndexObject, 0, -1)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", show.IndexObject, err)
+	}
+	defer r.Close()
+
+	if err := checkWriteTime(ctx, show); err != nil {
+		return err
+	}
+	err = replaceAtomically(ctx, show.IndexObject, storage.Conditions{GenerationMatch: attrs.Generation}, func(tmp string) error {
+		if err := writeInserted(ctx, tmp, r, item); err != nil {
+			return cannotStream(err)
+		}
+		return cannotStream(checkStreamedFeed(ctx, tmp, show))
+	})
+	if errors.Is(err, errCannotStream) {
+		return err
+	}
+	if isPreconditionFailed(err) {
+		return errCannotStream
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", show.IndexObject, err)
+	}
+
+	logger.Info("Inserted item into index.xml", "object", show.IndexObject, "bucket", bucketName,
+		"guid", item.GUID.Value)
+	feedUpdated(ctx, show)
+	return nil
+}
+
+// writeInserted creates the object name with the feed read from r, with
+// item inserted by insertItem. The object isn't created if insertItem
+// fails.
+func writeInserted(ctx context.Context, name string, r io.Reader, item Item) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w, err := indexStore.NewWriter(ctx, name, feedContentType, storage.Conditions{DoesNotExist: true})
+	if err != nil {
+		return err
+	}
+	if err := insertItem(w, r, item); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// checkStreamedFeed reads back the feed written to the object name and
+// checks it as a full update would before writing, and that its channel
+// metadata is what a full update would set.
+func checkStreamedFeed(ctx context.Context, name string, show *Show) error {
+	r, err := indexStore.NewRangeReader(ctx, name, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	channel, err := checkFeed(r)
+	if err != nil {
+		return fmt.Errorf("invalid feed: %w", err)
+	}
+	if !channelConfigured(channel, show) {
+		return errors.New("channel metadata differs from the configuration")
+	}
+	return nil
+}
+
+// channelConfigured reports whether applyChannelConfig would leave channel
+// as it is.
+func channelConfigured(channel *Channel, show *Show) bool {
+	configured := *channel
+	configured.AtomLinks = slices.Clone(channel.AtomLinks)
+	applyChannelConfig(&configured, show)
+	return reflect.DeepEqual(&configured, channel)
+}
+
+// cannotStream wraps err as errCannotStream, unless it is nil or already
+// is one.
+func cannotStream(err error) error {
+	if err == nil || errors.Is(err, errCannotStream) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", errCannotStream, err)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEpoch = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// testItem returns the item for episode n, published n hours after
+// testEpoch.
+func testItem(n int) Item {
+	name := fmt.Sprintf("ep%d.mp3", n)
+	return Item{
+		Title:       fmt.Sprintf("Episode %d", n),
+		PubDate:     testEpoch.Add(time.Duration(n) * time.Hour).Format(time.RFC1123Z),
+		GUID:        guidFor(name),
+		Enclosure:   Enclosure{URL: fileURL(name), Length: 1000, Type: "audio/mpeg"},
+		Description: &CDATA{Text: fmt.Sprintf("Notes for <b>episode %d</b>", n)},
+	}
+}
+
+// renderTestFeed returns the index.xml that writeFeed would write for items.
+func renderTestFeed(tb testing.TB, items ...Item) []byte {
+	tb.Helper()
+	feed := newFeed()
+	feed.Channel.Items = items
+	pages, err := renderFeed(shows[0], feed, "v1")
+	if err != nil {
+		tb.Fatalf("renderFeed: %v", err)
+	}
+	return []byte(pages[0])
+}
+
+func TestInsertItem(t *testing.T) {
+	republished := testItem(2)
+	republished.PubDate = testItem(4).PubDate
+	republished.Title = "Episode 2, again"
+
+	tests := []struct {
+		name  string
+		items []Item
+		item  Item
+		want  []Item
+	}{
+		{"empty feed", nil, testItem(1), []Item{testItem(1)}},
+		{"newest item", []Item{testItem(1), testItem(2)}, testItem(3), []Item{testItem(1), testItem(2), testItem(3)}},
+		{"same pubDate", []Item{testItem(1), testItem(2)}, testItem(2), []Item{testItem(1), testItem(2)}},
+		{"replaced item", []Item{testItem(1), testItem(2), testItem(3)}, republished, []Item{testItem(1), testItem(3), republished}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := insertItem(&buf, bytes.NewReader(renderTestFeed(t, tt.items...)), tt.item); err != nil {
+				t.Fatalf("insertItem: %v", err)
+			}
+			if want := renderTestFeed(t, tt.want...); !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("insertItem wrote\n%s\nwant\n%s", buf.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestInsertItemCannotStream(t *testing.T) {
+	older := renderTestFeed(t, testItem(1), testItem(3))
+
+	oldMax := feedMaxItems
+	feedMaxItems = 1
+	paginated := renderTestFeed(t, testItem(1), testItem(2))
+	feedMaxItems = oldMax
+
+	noPodcastNS := bytes.Replace(renderTestFeed(t, testItem(1)), []byte(` xmlns:podcast="`+podcastNamespace+`"`), nil, 1)
+
+	tests := []struct {
+		name string
+		doc  []byte
+	}{
+		{"older than an existing item", older},
+		{"paginated", paginated},
+		{"missing namespace", noPodcastNS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := insertItem(&buf, bytes.NewReader(tt.doc), testItem(2)); !errors.Is(err, errCannotStream) {
+				t.Errorf("insertItem = %v, want errCannotStream", err)
+			}
+		})
+	}
+}
+
+// BenchmarkInsertItem compares adding an episode to a 10,000-item feed by
+// parsing and re-rendering the whole feed with adding it by streaming.
+func BenchmarkInsertItem(b *testing.B) {
+	const n = 10000
+	items := make([]Item, n)
+	for i := range items {
+		items[i] = testItem(i)
+	}
+	doc := renderTestFeed(b, items...)
+	item := testItem(n)
+
+	b.Run("parse", func(b *testing.B) {
+		insert := func() any {
+			feed, err := decodeFeed(bytes.NewReader(doc))
+			if err != nil {
+				b.Fatal(err)
+			}
+			feed.Channel.Items = append(feed.Channel.Items, item)
+			pages, err := renderFeed(shows[0], feed, "v1")
+			if err != nil {
+				b.Fatal(err)
+			}
+			return []any{feed, pages}
+		}
+		b.ReportAllocs()
+		b.SetBytes(int64(len(doc)))
+		for b.Loop() {
+			insert()
+		}
+		reportRetained(b, insert)
+	})
+
+	b.Run("stream", func(b *testing.B) {
+		insert := func() any {
+			// As streamItem writes straight to the temporary object, the
+			// result isn't held in memory.
+			if err := insertItem(io.Discard, bytes.NewReader(doc), item); err != nil {
+				b.Fatal(err)
+			}
+			return nil
+		}
+		b.ReportAllocs()
+		b.SetBytes(int64(len(doc)))
+		for b.Loop() {
+			insert()
+		}
+		reportRetained(b, insert)
+	})
+}
+
+// reportRetained reports, as retained-B, how much heap the result of insert
+// holds on to: what is still in use when the new feed is written.
+func reportRetained(b *testing.B, insert func() any) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	result := insert()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(result)
+	b.ReportMetric(float64(after.HeapAlloc)-float64(before.HeapAlloc), "retained-B")
+}
+
+func TestStreamItem(t *testing.T) {
+	index, _ := useFakeStores(t)
+	putTestFeed(t, index, testItem(1), testItem(2))
+
+	if err := streamItem(context.Background(), shows[0], testItem(3)); err != nil {
+		t.Fatalf("streamItem: %v", err)
+	}
+	if got, want := index.content(shows[0].IndexObject), renderTestFeed(t, testItem(1), testItem(2), testItem(3)); got != string(want) {
+		t.Errorf("index.xml is\n%s\nwant\n%s", got, want)
+	}
+	if names := index.names(); !slices.Equal(names, []string{shows[0].IndexObject}) {
+		t.Errorf("index bucket holds %q, want only %s", names, shows[0].IndexObject)
+	}
+}
+
+func TestStreamItemChannelChanged(t *testing.T) {
+	index, files := useFakeStores(t)
+	doc := putTestFeed(t, index, testItem(1), testItem(2))
+	files.put("ep3.mp3", []byte("not really audio"), nil)
+	setForTest(t, &shows[0].Title, "Renamed Show")
+
+	// The streamed feed would keep the old title, so it isn't published.
+	err := streamItem(context.Background(), shows[0], testItem(3))
+	if !errors.Is(err, errCannotStream) {
+		t.Fatalf("streamItem = %v, want errCannotStream", err)
+	}
+	if got := index.content(shows[0].IndexObject); got != string(doc) {
+		t.Errorf("index.xml changed to\n%s", got)
+	}
+	if names := index.names(); !slices.Equal(names, []string{shows[0].IndexObject}) {
+		t.Errorf("index bucket holds %q, want only %s", names, shows[0].IndexObject)
+	}
+
+	// processFile falls back to the full update, which sets the new title.
+	if _, err := processFile(context.Background(), "ep3.mp3", false); err != nil {
+		t.Fatalf("processFile: %v", err)
+	}
+	feed := readTestFeed(t, index)
+	if feed.Channel.Title != "Renamed Show" {
+		t.Errorf("title = %q, want Renamed Show", feed.Channel.Title)
+	}
+	if n := len(feed.Channel.Items); n != 3 {
+		t.Errorf("feed has %d items, want 3", n)
+	}
+}
+
+func TestStreamItemInvalidFeed(t *testing.T) {
+	index, files := useFakeStores(t)
+	bad := testItem(1)
+	bad.Enclosure.Type = ""
+	doc := putTestFeed(t, index, bad)
+	files.put("ep2.mp3", []byte("not really audio"), nil)
+
+	unchanged := func() {
+		t.Helper()
+		if got := index.content(shows[0].IndexObject); got != string(doc) {
+			t.Errorf("index.xml changed to\n%s", got)
+		}
+		if names := index.names(); !slices.Equal(names, []string{shows[0].IndexObject}) {
+			t.Errorf("index bucket holds %q, want only %s", names, shows[0].IndexObject)
+		}
+	}
+
+	// insertItem copies the incomplete enclosure along; the check of the
+	// temporary object catches it before it is published.
+	err := streamItem(context.Background(), shows[0], testItem(2))
+	if !errors.Is(err, errCannotStream) {
+		t.Errorf("streamItem = %v, want errCannotStream", err)
+	}
+	unchanged()
+
+	// The full update that processFile falls back to rejects it too.
+	if _, err := processFile(context.Background(), "ep2.mp3", false); err == nil || !strings.Contains(err.Error(), "incomplete enclosure") {
+		t.Errorf("processFile = %v, want the incomplete enclosure reported", err)
+	}
+	unchanged()
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	retryInitialBackoff = 200 * time.Millisecond
+	retryMaxBackoff     = 10 * time.Second
+)
+
+// withRetry calls fn until it succeeds, returns a non-retryable error, or
+// gcsMaxAttempts is reached. Retries wait with exponential backoff and full
+// jitter, or as long as a Retry-After header asks, and stop early if ctx is
+// done.
+func withRetry(ctx context.Context, fn func() error) error {
+	backoff := retryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= gcsMaxAttempts || !isRetryable(err) {
+			return err
+		}
+
+		wait := rand.N(backoff)
+		if d, ok := retryAfter(err); ok {
+			wait = d
+		}
+		logger.Warn("GCS request failed, retrying",
+			"attempt", attempt, "max_attempts", gcsMaxAttempts, "wait", wait.String(), "error", err)
+		select {
+		case <-clock.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		backoff = min(backoff*2, retryMaxBackoff)
+	}
+}
+
+// retryAfter returns the delay requested by the Retry-After header of a GCS
+// error response, given either in seconds or as an HTTP date. The delay is
+// capped at retryMaxBackoff, so a single response can't hold up the request
+// for longer than the backoff would.
+func retryAfter(err error) (time.Duration, bool) {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return 0, false
+	}
+	v := gerr.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		// Capped before conversion, as a huge value would overflow.
+		return time.Duration(min(secs, int(retryMaxBackoff/time.Second))) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return min(max(t.Sub(clock.Now()), 0), retryMaxBackoff), true
+	}
+	return 0, false
+}
+
+// isRetryable reports whether err is a transient GCS or network failure.
+func isRetryable(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusTooManyRequests || gerr.Code >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// writeSlots bounds how many GCS write operations run at once, so a burst of
+// events queues up instead of tripping rate limits.
+var writeSlots = make(chan struct{}, maxConcurrency)
+
+// acquireWriteSlot waits for a free write slot and returns a function that
+// releases it, or returns ctx's error if it is done first.
+func acquireWriteSlot(ctx context.Context) (func(), error) {
+	select {
+	case writeSlots <- struct{}{}:
+		return func() { <-writeSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ObjectStore is the set of bucket operations the service relies on. The
+// index and files buckets are each accessed through one.
+type ObjectStore interface {
+	// Read returns the full content of an object along with its attributes.
+	Read(ctx context.Context, name string) ([]byte, *storage.ObjectAttrs, error)
+	// NewRangeReader reads length bytes of an object starting at offset. A
+	// negative length reads to the end of the object. Bytes are read as
+	// stored, so objects with a Content-Encoding aren't decompressed.
+	NewRangeReader(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+	// Write replaces the content of an object, subject to cond.
+	Write(ctx context.Context, name, contentType string, content []byte, cond storage.Conditions) error
+	// NewWriter returns a writer whose content replaces that of an object,
+	// subject to cond, when it is closed. Cancelling ctx before Close
+	// abandons the write. Unlike Write, a failed write isn't retried, as
+	// the content can't be replayed.
+	NewWriter(ctx context.Context, name, contentType string, cond storage.Conditions) (io.WriteCloser, error)
+	// Copy copies object src to dst within the bucket, subject to cond on
+	// dst.
+	Copy(ctx context.Context, src, dst string, cond storage.Conditions) error
+	// Delete removes an object.
+	Delete(ctx context.Context, name string) error
+	// Attrs returns the attributes of an object.
+	Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error)
+	// List returns the attributes of every object whose name starts with
+	// prefix.
+	List(ctx context.Context, prefix string) ([]*storage.ObjectAttrs, error)
+	// SignedURL returns a signed URL granting temporary access to an object.
+	SignedURL(name string, opts *storage.SignedURLOptions) (string, error)
+}
+
+// limitedStore is an ObjectStore whose writes, copies and deletes each wait
+// for a slot in writeSlots, so at most MAX_CONCURRENCY of them run at once
+// across every store.
+type limitedStore struct {
+	ObjectStore
+}
+
+func (s limitedStore) Write(ctx context.Context, name, contentType string, content []byte, cond storage.Conditions) error {
+	release, err := acquireWriteSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.ObjectStore.Write(ctx, name, contentType, content, cond)
+}
+
+// NewWriter holds the write slot until the writer is closed.
+func (s limitedStore) NewWriter(ctx context.Context, name, contentType string, cond storage.Conditions) (io.WriteCloser, error) {
+	release, err := acquireWriteSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.ObjectStore.NewWriter(ctx, name, contentType, cond)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releasingWriter{WriteCloser: w, release: release}, nil
+}
+
+func (s limitedStore) Copy(ctx context.Context, src, dst string, cond storage.Conditions) error {
+	release, err := acquireWriteSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.ObjectStore.Copy(ctx, src, dst, cond)
+}
+
+func (s limitedStore) Delete(ctx context.Context, name string) error {
+	release, err := acquireWriteSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.ObjectStore.Delete(ctx, name)
+}
+
+// releasingWriter releases a write slot when the writer it wraps is closed.
+type releasingWriter struct {
+	io.WriteCloser
+	release func()
+}
+
+func (w *releasingWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if w.release != nil {
+		w.release()
+		w.release = nil
+	}
+	return err
+}
+
+// gcsStore is an ObjectStore backed by a GCS bucket. Transient failures are
+// retried with withRetry.
+type gcsStore struct {
+	bucket *storage.BucketHandle
+}
+
+func newGCSStore(bucket *storage.BucketHandle) *gcsStore {
+	return &gcsStore{bucket: bucket}
+}
+
+func (s *gcsStore) Read(ctx context.Context, name string) ([]byte, *storage.ObjectAttrs, error) {
+	defer observeSince(gcsReadDuration, time.Now())
+
+	var content []byte
+	var attrs *storage.ObjectAttrs
+	err := withRetry(ctx, func() error {
+		reader, err := s.bucket.Object(name).NewReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		content, err = io.ReadAll(reader)
+		attrs = &storage.ObjectAttrs{
+			Name:            name,
+			Size:            reader.Attrs.Size,
+			ContentType:     reader.Attrs.ContentType,
+			ContentEncoding: reader.Attrs.ContentEncoding,
+			Generation:      reader.Attrs.Generation,
+			Metageneration:  reader.Attrs.Metageneration,
+			Updated:         reader.Attrs.LastModified,
+		}
+		return err
+	})
+	return content, attrs, err
+}
+
+func (s *gcsStore) NewRangeReader(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	var reader *storage.Reader
+	err := withRetry(ctx, func() error {
+		var err error
+		reader, err = s.bucket.Object(name).ReadCompressed(true).NewRangeReader(ctx, offset, length)
+		return err
+	})
+	return reader, err
+}
+
+func (s *gcsStore) Write(ctx context.Context, name, contentType string, content []byte, cond storage.Conditions) error {
+	defer observeSince(gcsWriteDuration, time.Now())
+
+	obj := s.bucket.Object(name)
+	if cond != (storage.Conditions{}) {
+		obj = obj.If(cond)
+	}
+
+	return withRetry(ctx, func() error {
+		writer := obj.NewWriter(ctx)
+		writer.ContentType = contentType
+
+		if _, err := writer.Write(content); err != nil {
+			writer.Close()
+			return err
+		}
+		return writer.Close()
+	})
+}
+
+func (s *gcsStore) NewWriter(ctx context.Context, name, contentType string, cond storage.Conditions) (io.WriteCloser, error) {
+	obj := s.bucket.Object(name)
+	if cond != (storage.Conditions{}) {
+		obj = obj.If(cond)
+	}
+	writer := obj.NewWriter(ctx)
+	writer.ContentType = contentType
+	return writer, nil
+}
+
+func (s *gcsStore) Copy(ctx context.Context, src, dst string, cond storage.Conditions) error {
+	defer observeSince(gcsWriteDuration, time.Now())
+
+	obj := s.bucket.Object(dst)
+	if cond != (storage.Conditions{}) {
+		obj = obj.If(cond)
+	}
+
+	return withRetry(ctx, func() error {
+		_, err := obj.CopierFrom(s.bucket.Object(src)).Run(ctx)
+		return err
+	})
+}
+
+func (s *gcsStore) Delete(ctx context.Context, name string) error {
+	return withRetry(ctx, func() error {
+		return s.bucket.Object(name).Delete(ctx)
+	})
+}
+
+func (s *gcsStore) Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	var attrs *storage.ObjectAttrs
+	err := withRetry(ctx, func() error {
+		var err error
+		attrs, err = s.bucket.Object(name).Attrs(ctx)
+		return err
+	})
+	return attrs, err
+}
+
+func (s *gcsStore) List(ctx context.Context, prefix string) ([]*storage.ObjectAttrs, error) {
+	var objects []*storage.ObjectAttrs
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, attrs)
+	}
+}
+
+func (s *gcsStore) SignedURL(name string, opts *storage.SignedURLOptions) (string, error) {
+	return s.bucket.SignedURL(name, opts)
+}
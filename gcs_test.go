@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestWithRetryRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		retryAfter string
+		want       time.Duration
+	}{
+		{"seconds", "3", 3 * time.Second},
+		{"http date", now.Add(5 * time.Second).Format(http.TimeFormat), 5 * time.Second},
+		{"date in the past", now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"a day", "86400", retryMaxBackoff},
+		{"overflowing seconds", "99999999999999", retryMaxBackoff},
+		{"date a day away", now.Add(24 * time.Hour).Format(http.TimeFormat), retryMaxBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeClock(t, now)
+
+			calls := 0
+			err := withRetry(context.Background(), func() error {
+				calls++
+				if calls == 1 {
+					return &googleapi.Error{
+						Code:   http.StatusTooManyRequests,
+						Header: http.Header{"Retry-After": {tt.retryAfter}},
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("withRetry: %v", err)
+			}
+			if calls != 2 {
+				t.Errorf("fn called %d times, want 2", calls)
+			}
+			if want := []time.Duration{tt.want}; !slices.Equal(fake.waits, want) {
+				t.Errorf("waited %v, want %v", fake.waits, want)
+			}
+		})
+	}
+}
+
+func TestWithRetryGivesUp(t *testing.T) {
+	fake := useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+
+	rateLimited := &googleapi.Error{
+		Code:   http.StatusTooManyRequests,
+		Header: http.Header{"Retry-After": {"1"}},
+	}
+	calls := 0
+	err := withRetry(context.Background(), func() error {
+		calls++
+		return rateLimited
+	})
+	if !errors.Is(err, rateLimited) {
+		t.Errorf("withRetry = %v, want the last error", err)
+	}
+	if calls != gcsMaxAttempts {
+		t.Errorf("fn called %d times, want %d", calls, gcsMaxAttempts)
+	}
+	if len(fake.waits) != gcsMaxAttempts-1 {
+		t.Errorf("waited %d times, want %d", len(fake.waits), gcsMaxAttempts-1)
+	}
+}
+
+func TestWriteSlotsSerializeProcessFile(t *testing.T) {
+	index, files := useFakeStores(t)
+	indexStore = limitedStore{index}
+	setForTest(t, &writeSlots, make(chan struct{}, 1))
+	names := []string{"ep1.mp3", "ep2.mp3"}
+	for _, name := range names {
+		files.put(name, []byte("not really audio"), nil)
+	}
+
+	// Each write to the index bucket takes a while, so unbounded writes
+	// from the two calls would overlap.
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	index.fail = func(op, name string) error {
+		if op == "Write" || op == "Copy" || op == "Delete" {
+			mu.Lock()
+			inFlight++
+			maxInFlight = max(maxInFlight, inFlight)
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(names))
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = processFile(context.Background(), name, false)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("processFile(%q): %v", names[i], err)
+		}
+	}
+	if maxInFlight != 1 {
+		t.Errorf("%d writes ran at once, want 1", maxInFlight)
+	}
+	if n := len(readTestFeed(t, index).Channel.Items); n != 2 {
+		t.Errorf("feed has %d items, want 2", n)
+	}
+}
+
+func TestStorageClientOptionsEmulator(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	emulator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"bucket":"podcasts","name":"index.xml","generation":"7","size":"3"}`)
+	}))
+	defer emulator.Close()
+
+	// The credentials file doesn't exist; it is ignored in favour of the
+	// emulator.
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(emulator.URL, "http://"))
+	t.Setenv("GCS_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	opts := storageClientOptions()
+	if len(opts) != 0 {
+		t.Errorf("with the emulator got %d options, want none", len(opts))
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer client.Close()
+	attrs, err := client.Bucket("podcasts").Object("index.xml").Attrs(ctx)
+	if err != nil {
+		t.Fatalf("Attrs: %v", err)
+	}
+	if attrs.Generation != 7 {
+		t.Errorf("generation = %d, want 7", attrs.Generation)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"/storage/v1/b/podcasts/o/index.xml"}; !slices.Equal(paths, want) {
+		t.Errorf("emulator received %q, want %q", paths, want)
+	}
+}
+
+func TestStorageClientOptionsCredentials(t *testing.T) {
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	t.Setenv("GCS_CREDENTIALS_FILE", "")
+	if opts := storageClientOptions(); len(opts) != 0 {
+		t.Errorf("with nothing set got %d options, want none", len(opts))
+	}
+
+	t.Setenv("GCS_CREDENTIALS_FILE", "/secrets/sa.json")
+	if opts := storageClientOptions(); len(opts) != 1 {
+		t.Errorf("with GCS_CREDENTIALS_FILE set got %d options, want 1", len(opts))
+	}
+}
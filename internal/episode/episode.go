@@ -0,0 +1,128 @@
+// Package episode derives episode details from audio file names: whether a
+// file is audio at all, its MIME type, a readable title, season and episode
+// numbers, and a leading publication date.
+package episode
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// audioTypes maps supported audio file extensions to their enclosure MIME types.
+var audioTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".aac":  "audio/aac",
+	".wav":  "audio/wav",
+}
+
+// IsAudio reports whether name has a supported audio file extension.
+func IsAudio(name string) bool {
+	_, ok := audioTypes[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// MIMEType returns the enclosure MIME type for name based on its extension,
+// defaulting to audio/mpeg.
+func MIMEType(name string) string {
+	if t, ok := audioTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		return t
+	}
+	return "audio/mpeg"
+}
+
+// Title derives a readable title from the base name of name, without its
+// extension.
+func Title(name string) string {
+	base := filepath.Base(name)
+	return SanitizeTitle(strings.TrimSuffix(base, filepath.Ext(base)))
+}
+
+// Stopwords are the words SanitizeTitle writes in lower case unless they
+// start the title. They are matched ignoring case.
+var Stopwords = []string{"a", "an", "and", "of", "the"}
+
+// SanitizeTitle turns a file name into a readable title: underscores and
+// dashes become spaces, runs of whitespace collapse to one, and each word
+// starts with a capital letter except for Stopwords after the first. Digits
+// are kept, so "the_daily_news_of_ep-5" becomes "The Daily News of Ep 5".
+func SanitizeTitle(s string) string {
+	s = strings.NewReplacer("_", " ", "-", " ").Replace(s)
+
+	words := strings.Fields(s)
+	for i, w := range words {
+		if i > 0 && isStopword(w) {
+			words[i] = strings.ToLower(w)
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(w)
+		words[i] = string(unicode.ToUpper(r)) + w[size:]
+	}
+	return strings.Join(words, " ")
+}
+
+func isStopword(w string) bool {
+	for _, stop := range Stopwords {
+		if strings.EqualFold(w, stop) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	seasonEpisodePattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])s(\d{1,3})[ _.-]?e(\d{1,4})(?:[^0-9]|$)`)
+	episodePattern       = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(?:ep|episode)[ _.-]?(\d{1,4})(?:[^0-9]|$)`)
+)
+
+// Numbers parses a season and episode number from a name such as
+// "show_S01E04.mp3" or "show_ep12.mp3". Numbers that aren't found are
+// returned as 0.
+func Numbers(name string) (season, episode int) {
+	base := filepath.Base(name)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	if m := seasonEpisodePattern.FindStringSubmatch(base); m != nil {
+		season, _ = strconv.Atoi(m[1])
+		episode, _ = strconv.Atoi(m[2])
+		return season, episode
+	}
+	if m := episodePattern.FindStringSubmatch(base); m != nil {
+		episode, _ = strconv.Atoi(m[1])
+	}
+	return 0, episode
+}
+
+// dateLayouts are the date formats recognised at the start of a name.
+var dateLayouts = []string{time.DateOnly, "20060102"}
+
+// DatePrefix parses a date from the start of name's base name, such as
+// "2024-05-01_morning-show.mp3" or "20240501 morning show.mp3", as midnight
+// UTC that day. It also returns the rest of the base name with the separator
+// after the date removed.
+func DatePrefix(name string) (date time.Time, rest string, ok bool) {
+	base := filepath.Base(name)
+	for _, layout := range dateLayouts {
+		if len(base) < len(layout) {
+			continue
+		}
+		t, err := time.Parse(layout, base[:len(layout)])
+		if err != nil {
+			continue
+		}
+		rest = base[len(layout):]
+		if rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+			continue // more digits, so not a date prefix
+		}
+		return t, strings.TrimLeft(rest, " _-"), true
+	}
+	return time.Time{}, "", false
+}
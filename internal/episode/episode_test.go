@@ -0,0 +1,126 @@
+package episode
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsAudio(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"ep1.mp3", true},
+		{"show/ep1.M4A", true},
+		{"ep1.flac", true},
+		{"ep1.opus", true},
+		{"ep1.jpg", false},
+		{"ep1.mp3.txt", false},
+		{"mp3", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsAudio(tt.name); got != tt.want {
+			t.Errorf("IsAudio(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMIMEType(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"ep1.mp3", "audio/mpeg"},
+		{"ep1.m4a", "audio/mp4"},
+		{"ep1.OGG", "audio/ogg"},
+		{"ep1.opus", "audio/ogg"},
+		{"ep1.aac", "audio/aac"},
+		{"ep1.wav", "audio/wav"},
+		{"ep1.flac", "audio/flac"},
+		{"ep1.unknown", "audio/mpeg"},
+	}
+	for _, tt := range tests {
+		if got := MIMEType(tt.name); got != tt.want {
+			t.Errorf("MIMEType(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeTitle(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"my_first-episode", "My First Episode"},
+		{"a__b___c", "A B C"},
+		{"  spaced -_- out  ", "Spaced Out"},
+		{"a\t\tb", "A B"},
+		{"episode_10_part_2", "Episode 10 Part 2"},
+		{"2024 review", "2024 Review"},
+		{"the_daily_news_of_ep-5", "The Daily News of Ep 5"},
+		{"rise_OF_THE_machines", "Rise of the Machines"},
+		{"an_apple_and_a_pear", "An Apple and a Pear"},
+		{"éclair", "Éclair"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := SanitizeTitle(tt.in); got != tt.want {
+			t.Errorf("SanitizeTitle(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTitle(t *testing.T) {
+	if got, want := Title("show/the_pilot.mp3"), "The Pilot"; got != want {
+		t.Errorf("Title = %q, want %q", got, want)
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	tests := []struct {
+		name            string
+		season, episode int
+	}{
+		{"show_S01E04.mp3", 1, 4},
+		{"show s2e10.mp3", 2, 10},
+		{"show_S03.E07.mp3", 3, 7},
+		{"show_ep12.mp3", 0, 12},
+		{"Episode 7.mp3", 0, 7},
+		{"show-ep_3-finale.mp3", 0, 3},
+		{"ep12345.mp3", 0, 0},
+		{"keep3.mp3", 0, 0},
+		{"interview.mp3", 0, 0},
+	}
+	for _, tt := range tests {
+		season, episode := Numbers(tt.name)
+		if season != tt.season || episode != tt.episode {
+			t.Errorf("Numbers(%q) = %d, %d, want %d, %d", tt.name, season, episode, tt.season, tt.episode)
+		}
+	}
+}
+
+func TestDatePrefix(t *testing.T) {
+	may1 := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		date time.Time
+		rest string
+		ok   bool
+	}{
+		{"2024-05-01_morning-show.mp3", may1, "morning-show.mp3", true},
+		{"20240501 morning show.mp3", may1, "morning show.mp3", true},
+		{"show/2024-05-01-news.mp3", may1, "news.mp3", true},
+		{"2024-05-01.mp3", may1, ".mp3", true},
+		{"202405011.mp3", time.Time{}, "", false},
+		{"2024-13-01_news.mp3", time.Time{}, "", false},
+		{"news_2024-05-01.mp3", time.Time{}, "", false},
+		{"2024.mp3", time.Time{}, "", false},
+	}
+	for _, tt := range tests {
+		date, rest, ok := DatePrefix(tt.name)
+		if !date.Equal(tt.date) || rest != tt.rest || ok != tt.ok {
+			t.Errorf("DatePrefix(%q) = %v, %q, %v, want %v, %q, %v", tt.name, date, rest, ok, tt.date, tt.rest, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// ItemTemplateData is the data available to ITEM_TEMPLATE, a text/template
+// whose output is added to the end of every new item. The output must be a
+// sequence of XML elements; elements the feed already writes, such as title,
+// must not be repeated. Values are written as they are, so pipe text through
+// the xml function, e.g. <custom:title>{{.Title | xml}}</custom:title>, and
+// declare any namespace prefix on the element that uses it.
+type ItemTemplateData struct {
+	Title    string // the item's title
+	PubDate  string // the item's pubDate, as written in the feed
+	FileName string // the object's base name, e.g. "ep1.mp3"
+	Size     int64  // the enclosure length in bytes
+	Type     string // the enclosure MIME type
+	GUID     string
+}
+
+// itemTemplate is the parsed ITEM_TEMPLATE, or nil if none is configured.
+var itemTemplate *template.Template
+
+// loadItemTemplate parses the template file at path and checks that it
+// renders well-formed XML for a sample item.
+func loadItemTemplate(path string) (*template.Template, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read item template: %w", err)
+	}
+
+	tmpl, err := template.New(filepath.Base(path)).
+		Funcs(template.FuncMap{"xml": xmlEscape}).
+		Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse item template: %w", err)
+	}
+
+	sample := ItemTemplateData{
+		Title:    "Sample <Episode> & More",
+		PubDate:  formatPubDate(clock.Now()),
+		FileName: "sample.mp3",
+		Size:     1,
+		Type:     "audio/mpeg",
+		GUID:     "sample.mp3",
+	}
+	if _, err := renderItemTemplate(tmpl, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// renderItemTemplate executes tmpl for data and parses its output into the
+// elements to add to the item.
+func renderItemTemplate(tmpl *template.Template, data ItemTemplateData) ([]XMLElement, error) {
+	var buf strings.Builder
+	buf.WriteString("<item>")
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to execute item template: %w", err)
+	}
+	buf.WriteString("</item>")
+
+	var item struct {
+		Extra []XMLElement `xml:",any"`
+	}
+	d := xml.NewTokenDecoder(prefixedTokenReader{xml.NewDecoder(strings.NewReader(buf.String()))})
+	if err := d.Decode(&item); err != nil {
+		return nil, fmt.Errorf("item template output is not valid XML: %w", err)
+	}
+	return item.Extra, nil
+}
+
+// xmlEscape escapes s for use as XML text or an attribute value.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
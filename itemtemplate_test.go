@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+// writeTemplate writes content to a template file in a temporary directory
+// and returns its path.
+func writeTemplate(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "item.tmpl")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestItemTemplate(t *testing.T) {
+	const tmpl = `<custom:file xmlns:custom="https://example.com/ns">{{.FileName | xml}}</custom:file>` +
+		`<custom:title xmlns:custom="https://example.com/ns">{{.Title | xml}}</custom:title>`
+	parsed, err := loadItemTemplate(writeTemplate(t, tmpl))
+	if err != nil {
+		t.Fatalf("loadItemTemplate: %v", err)
+	}
+	setForTest(t, &itemTemplate, parsed)
+
+	index, files := useFakeStores(t)
+	files.put("ep1.mp3", []byte("not really audio"), &storage.ObjectAttrs{
+		Metadata: map[string]string{"title": "Q&A <Live>"},
+	})
+	if _, err := processFile(context.Background(), "ep1.mp3", false); err != nil {
+		t.Fatalf("processFile: %v", err)
+	}
+
+	content := index.content(shows[0].IndexObject)
+	for _, want := range []string{
+		`<custom:file xmlns:custom="https://example.com/ns">ep1.mp3</custom:file>`,
+		`<custom:title xmlns:custom="https://example.com/ns">Q&amp;A &lt;Live&gt;</custom:title>`,
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("feed has no %s:\n%s", want, content)
+		}
+	}
+}
+
+func TestLoadItemTemplateInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unparseable", `<custom:title>{{.Title</custom:title>`, "failed to parse"},
+		{"unknown field", `<custom:season>{{.Season}}</custom:season>`, "failed to execute"},
+		{"unescaped text", `<custom:title>{{.Title}}</custom:title>`, "not valid XML"},
+		{"unclosed element", `<custom:title>{{.Title | xml}}`, "not valid XML"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadItemTemplate(writeTemplate(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadItemTemplate = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := loadItemTemplate(filepath.Join(t.TempDir(), "missing.tmpl")); err == nil {
+		t.Error("loadItemTemplate of a missing file succeeded")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const jsonFeedVersion = "https://jsonfeed.org/version/1.1"
+
+// JSONFeed is a JSON Feed 1.1 document.
+type JSONFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url,omitempty"`
+	FeedURL     string         `json:"feed_url,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Icon        string         `json:"icon,omitempty"`
+	Language    string         `json:"language,omitempty"`
+	Authors     []JSONAuthor   `json:"authors,omitempty"`
+	Items       []JSONFeedItem `json:"items"`
+}
+
+// JSONAuthor is the author of a JSON Feed or one of its items.
+type JSONAuthor struct {
+	Name string `json:"name"`
+}
+
+// JSONFeedItem is one episode in a JSON Feed.
+type JSONFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url,omitempty"`
+	Title         string           `json:"title,omitempty"`
+	ContentText   string           `json:"content_text"`
+	Image         string           `json:"image,omitempty"`
+	DatePublished string           `json:"date_published,omitempty"`
+	Authors       []JSONAuthor     `json:"authors,omitempty"`
+	Attachments   []JSONAttachment `json:"attachments,omitempty"`
+}
+
+// JSONAttachment is an episode's audio file in a JSON Feed.
+type JSONAttachment struct {
+	URL         string `json:"url"`
+	MIMEType    string `json:"mime_type"`
+	SizeInBytes int64  `json:"size_in_bytes,omitempty"`
+}
+
+// jsonFeed converts an RSS feed to JSON Feed, published at feedURL.
+func jsonFeed(feed *RSS, feedURL string) JSONFeed {
+	c := feed.Channel
+	doc := JSONFeed{
+		Version:     jsonFeedVersion,
+		Title:       c.Title,
+		HomePageURL: c.Link,
+		FeedURL:     feedURL,
+		Description: c.Description,
+		Language:    c.Language,
+		Items:       []JSONFeedItem{},
+	}
+	if c.ITunesImage != nil {
+		doc.Icon = c.ITunesImage.Href
+	}
+	if c.ITunesAuthor != "" {
+		doc.Authors = []JSONAuthor{{Name: c.ITunesAuthor}}
+	}
+
+	for _, item := range c.Items {
+		ji := JSONFeedItem{
+			ID:          item.GUID.Value,
+			URL:         item.Enclosure.URL,
+			Title:       item.Title,
+			ContentText: item.Title,
+			Attachments: []JSONAttachment{{
+				URL:         item.Enclosure.URL,
+				MIMEType:    item.Enclosure.Type,
+				SizeInBytes: item.Enclosure.Length,
+			}},
+		}
+		if ji.ID == "" {
+			ji.ID = item.Enclosure.URL
+		}
+		if item.Description != nil && item.Description.Text != "" {
+			ji.ContentText = item.Description.Text
+		}
+		if item.ITunesImage != nil {
+			ji.Image = item.ITunesImage.Href
+		}
+		if t := item.pubTime(); !t.IsZero() {
+			ji.DatePublished = t.Format(time.RFC3339)
+		}
+		if item.ITunesAuthor != "" {
+			ji.Authors = []JSONAuthor{{Name: item.ITunesAuthor}}
+		}
+		doc.Items = append(doc.Items, ji)
+	}
+	return doc
+}
+
+// jsonFeedHandler serves a show's feed as JSON Feed. The show is chosen with
+// ?show=, defaulting to the first.
+func jsonFeedHandler(w http.ResponseWriter, r *http.Request) {
+	show := showNamed(r.URL.Query().Get("show"))
+	if show == nil {
+		notFoundHandler(w, r)
+		return
+	}
+
+	ctx, cancel := readContext(r.Context())
+	defer cancel()
+
+	index, err := getIndexXML(ctx, show)
+	if err != nil {
+		logger.Error("Error fetching index.xml", "error", err)
+		writeError(w, http.StatusInternalServerError, "feed_read_failed", "Failed to fetch podcast feed")
+		return
+	}
+
+	feed, err := parseFeed(index.Content)
+	if err != nil {
+		logger.Error("Error parsing index.xml", "error", err)
+		writeError(w, http.StatusInternalServerError, "feed_parse_failed", "Failed to parse podcast feed")
+		return
+	}
+
+	feedURL := publicFeedURL + ".json"
+	if show.Name != "" {
+		feedURL += "?show=" + show.Name
+	}
+
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+	w.Header().Set("ETag", index.etag())
+	json.NewEncoder(w).Encode(jsonFeed(feed, feedURL))
+}
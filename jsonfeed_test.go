@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestJSONFeedHandler(t *testing.T) {
+	index, _ := useFakeStores(t)
+	putTestFeed(t, index, testItem(1), testItem(2))
+
+	w := serve(jsonFeedHandler, http.MethodGet, "/feed.json", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	// Decode loosely, so fields the spec requires are checked by their JSON
+	// names rather than through JSONFeed.
+	var doc map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("response isn't JSON: %v", err)
+	}
+	if doc["version"] != jsonFeedVersion {
+		t.Errorf("version = %v, want %s", doc["version"], jsonFeedVersion)
+	}
+	if title, _ := doc["title"].(string); title == "" {
+		t.Error("feed has no title")
+	}
+	items, ok := doc["items"].([]any)
+	if !ok || len(items) != 2 {
+		t.Fatalf("items = %v, want 2 items", doc["items"])
+	}
+
+	// Items are newest first, as in the RSS feed.
+	want := testItem(2)
+	item, _ := items[0].(map[string]any)
+	if item["id"] != want.GUID.Value {
+		t.Errorf("id = %v, want %s", item["id"], want.GUID.Value)
+	}
+	if published, _ := item["date_published"].(string); published != want.pubTime().Format(time.RFC3339) {
+		t.Errorf("date_published = %q, want %s", published, want.pubTime().Format(time.RFC3339))
+	}
+	attachments, _ := item["attachments"].([]any)
+	if len(attachments) != 1 {
+		t.Fatalf("attachments = %v, want one", item["attachments"])
+	}
+	attachment, _ := attachments[0].(map[string]any)
+	if attachment["url"] != want.Enclosure.URL || attachment["mime_type"] != want.Enclosure.Type ||
+		attachment["size_in_bytes"] != float64(want.Enclosure.Length) {
+		t.Errorf("attachment = %v, want %s, %s, %d", attachment, want.Enclosure.URL, want.Enclosure.Type, want.Enclosure.Length)
+	}
+}
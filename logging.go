@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logger writes structured JSON logs that Cloud Logging understands. It is
+// also installed as the slog and log default.
+var logger = newLogger(os.Stdout)
+
+// newLogger returns a JSON logger writing to w, using the field names Cloud
+// Logging expects for the message and severity. Records below LOG_LEVEL are
+// dropped.
+func newLogger(w io.Writer) *slog.Logger {
+	level, err := parseLogLevel(os.Getenv("LOG_LEVEL"))
+	l := slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: cloudLoggingAttr,
+	}))
+	slog.SetDefault(l)
+	if err != nil {
+		l.Warn("Invalid LOG_LEVEL, using INFO", "value", os.Getenv("LOG_LEVEL"), "error", err)
+	}
+	return l
+}
+
+// parseLogLevel parses a log level name such as DEBUG, INFO, WARN or ERROR,
+// in any case. Cloud Logging's WARNING is accepted for WARN. An empty or
+// invalid value gives INFO; the latter also returns an error.
+func parseLogLevel(s string) (slog.Level, error) {
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if strings.EqualFold(s, "WARNING") {
+		s = "WARN"
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return slog.LevelInfo, err
+	}
+	return level, nil
+}
+
+// cloudLoggingAttr renames slog's built-in keys to their Cloud Logging
+// equivalents so that severities are mapped correctly.
+func cloudLoggingAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+
+	switch a.Key {
+	case slog.MessageKey:
+		a.Key = "message"
+	case slog.LevelKey:
+		a.Key = "severity"
+		if level, ok := a.Value.Any().(slog.Level); ok && level == slog.LevelWarn {
+			a.Value = slog.StringValue("WARNING")
+		}
+	}
+	return a
+}
+
+// fatal logs msg at ERROR and exits.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
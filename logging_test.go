@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+// captureLogs sends logger's output to a buffer for the duration of the
+// test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	old := logger
+	logger = newLogger(&buf)
+	t.Cleanup(func() {
+		logger = old
+		slog.SetDefault(old)
+	})
+	return &buf
+}
+
+func TestProcessFileLogsObject(t *testing.T) {
+	_, files := useFakeStores(t)
+	files.put("pilot.mp3", []byte("not really audio"), nil)
+	logs := captureLogs(t)
+
+	if _, err := processFile(context.Background(), "pilot.mp3", false); err != nil {
+		t.Fatalf("processFile: %v", err)
+	}
+
+	found := false
+	dec := json.NewDecoder(logs)
+	for dec.More() {
+		var entry map[string]any
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("log output isn't JSON: %v", err)
+		}
+		if entry["message"] != "Processing audio file" {
+			continue
+		}
+		found = true
+		if entry["object"] != "pilot.mp3" {
+			t.Errorf("object = %v, want pilot.mp3", entry["object"])
+		}
+		if entry["severity"] != "INFO" {
+			t.Errorf("severity = %v, want INFO", entry["severity"])
+		}
+	}
+	if !found {
+		t.Error("no \"Processing audio file\" log line")
+	}
+}
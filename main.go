@@ -2,36 +2,120 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"encoding/json" // For JSON unmarshalling
 
 	"cloud.google.com/go/storage"
+	"github.com/joshlavin/podcast-processor/internal/episode"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/http2"     // Import http2 package
 	"golang.org/x/net/http2/h2c" // Import h2c for cleartext HTTP/2
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
 )
 
 var (
-	bucketName      = os.Getenv("GCS_BUCKET")
-	filesBucketName = os.Getenv("GCS_FILES_BUCKET")
-	indexObject     = getEnv("GCS_INDEX_OBJECT", "index.xml")
-	port            = getEnv("PORT", "8080")
-	gcsClient       *storage.Client
-	cachedContent   string
-	cacheMutex      sync.RWMutex
-	cacheTime       time.Time
-	cacheTTL        = 60 * time.Second
+	bucketName       = os.Getenv("GCS_BUCKET")
+	filesBucketName  = os.Getenv("GCS_FILES_BUCKET")
+	indexObject      = getEnv("GCS_INDEX_OBJECT", "index.xml")
+	port             = getEnv("PORT", "8080")
+	processAudience  = os.Getenv("PROCESS_AUDIENCE")
+	processAPIKey    = os.Getenv("PROCESS_API_KEY")
+	allowUnauth      = getEnvBool("ALLOW_UNAUTH", false)
+	gcsClient        *storage.Client
+	indexStore       ObjectStore  // holds index.xml
+	filesStore       ObjectStore  // holds the audio files
+	cacheMutex       sync.RWMutex // guards each show's cached index.xml
+	cacheTTL         = getEnvDuration("CACHE_TTL", 60*time.Second)
+	cacheRevalidate  = getEnvBool("CACHE_CHECK_GENERATION", true)
+	signedURLTTL     = getEnvDuration("SIGNED_URL_TTL", 15*time.Minute)
+	signedURLDisp    = os.Getenv("SIGNED_URL_DISPOSITION") // "", "inline" or "attachment"
+	processTimeout   = getEnvDuration("PROCESS_TIMEOUT", 55*time.Minute)
+	readTimeout      = getEnvDuration("READ_TIMEOUT", 10*time.Second)
+	verifyAudioMagic = getEnvBool("VERIFY_AUDIO_MAGIC", false)
+	dryRunDefault    = getEnvBool("DRY_RUN", false) // /process also accepts ?dry=1
+	gcsMaxAttempts   = getEnvInt("GCS_MAX_ATTEMPTS", 4)
+	maxConcurrency   = getEnvInt("MAX_CONCURRENCY", 8) // concurrent GCS writes
+	feedMaxItems     = getEnvInt("FEED_MAX_ITEMS", 0)  // 0 keeps every item in index.xml
+	maxProxySize     = getEnvInt("MAX_PROXY_SIZE", 0)  // bytes; larger files are redirected in proxy mode
+	publicFeedURL    = getEnv("PUBLIC_FEED_URL", "https://podcasts.jlavin.com/feed")
+	corsOrigin       = getEnv("CORS_ORIGIN", "*")
+	fileServeMode    = getEnv("FILE_SERVE_MODE", "redirect") // "redirect" or "proxy"
+	pubDateSource    = getEnv("PUBDATE_SOURCE", "created")   // "created", "updated" or "filename"
+	enclosureBaseURL = getEnv("ENCLOSURE_BASE_URL", "https://podcasts.jlavin.com/files/")
+	filesPrefix      = os.Getenv("FILES_PREFIX") // e.g. "episodes/"; only objects under it are episodes
+	websubHub        = os.Getenv("WEBSUB_HUB")   // WebSub hub pinged after each feed update
+	titleStopwords   = os.Getenv("TITLE_STOPWORDS")
+	itemTemplatePath = os.Getenv("ITEM_TEMPLATE")
+
+	// Channel metadata written on every feed update.
+	feedTitle       = getEnv("FEED_TITLE", "Josh's Feeds")
+	feedLink        = getEnv("FEED_LINK", "https://joshlavin.com/feeds/")
+	feedDescription = getEnv("FEED_DESCRIPTION", "Random podcasts")
+	feedAuthor      = getEnv("FEED_AUTHOR", "Josh Lavin")
+	feedLanguage    = getEnv("FEED_LANGUAGE", "en-us")
+	feedImageURL    = os.Getenv("FEED_IMAGE_URL")
+	feedCategory    = os.Getenv("FEED_CATEGORY")
+	feedExplicit    = getEnvBool("FEED_EXPLICIT", false)
+
+	// HTTP server timeouts. A zero duration means no timeout.
+	serverReadTimeout  = getEnvDuration("SERVER_READ_TIMEOUT", 30*time.Second)
+	serverWriteTimeout = getEnvDuration("SERVER_WRITE_TIMEOUT", 60*time.Second)
+	serverIdleTimeout  = getEnvDuration("SERVER_IDLE_TIMEOUT", 120*time.Second)
+
+	// httpClient makes every outbound HTTP call, such as WebSub hub pings,
+	// so a slow remote server can't hold up a request indefinitely.
+	httpClient = &http.Client{Timeout: getEnvDuration("HTTP_CLIENT_TIMEOUT", 10*time.Second)}
 )
 
+// shutdownTimeout is how long in-flight requests get to finish after
+// SIGTERM. Cloud Run allows 10 seconds before killing the container.
+const shutdownTimeout = 10 * time.Second
+
+// maxWriteAttempts bounds how many times an index.xml update is retried
+// after losing a race with a concurrent writer.
+const maxWriteAttempts = 5
+
+// minWriteTime is the least time that must be left before the request's
+// deadline for a feed write to start. With less, the update is abandoned
+// before anything is written rather than cut off part way.
+const minWriteTime = 5 * time.Second
+
+// zeroSizeRecheckDelay is how long fileChange waits before re-reading the
+// attributes of an object whose size is reported as 0.
+const zeroSizeRecheckDelay = 2 * time.Second
+
+// eventTypeDeleted is the CloudEvent type Eventarc sends when an object is
+// deleted from a bucket.
+const eventTypeDeleted = "google.cloud.storage.object.v1.deleted"
+
+// eventTypeArchived is the CloudEvent type Eventarc sends when the live
+// version of an object in a bucket with versioning becomes noncurrent,
+// because the object was deleted or overwritten.
+const eventTypeArchived = "google.cloud.storage.object.v1.archived"
+
+// eventTypeMetadataUpdated is the CloudEvent type Eventarc sends when an
+// object's metadata changes.
+const eventTypeMetadataUpdated = "google.cloud.storage.object.v1.metadataUpdated"
+
 // StorageObjectData represents the data for a GCS object event.
 type StorageObjectData struct {
 	Name   string `json:"name"`
@@ -49,11 +133,97 @@ type CloudEvent struct {
 	Subject     string            `json:"subject"`
 }
 
-const xmlItemTemplate = `     <item>
-         <title>%s</title>
-         <pubDate>%s</pubDate>
-         <enclosure url="https://podcasts.jlavin.com/files/%s" length="%d" type="audio/mpeg" />
-     </item>`
+// PubSubPushMessage is the envelope Pub/Sub uses to deliver a message to a
+// push subscription.
+type PubSubPushMessage struct {
+	Message struct {
+		Data        []byte            `json:"data"` // base64 in JSON
+		Attributes  map[string]string `json:"attributes"`
+		MessageID   string            `json:"messageId"`
+		PublishTime string            `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// pubSubEventTypes maps GCS Pub/Sub notification event types to the
+// equivalent CloudEvent types.
+var pubSubEventTypes = map[string]string{
+	"OBJECT_FINALIZE":        "google.cloud.storage.object.v1.finalized",
+	"OBJECT_DELETE":          eventTypeDeleted,
+	"OBJECT_ARCHIVE":         eventTypeArchived,
+	"OBJECT_METADATA_UPDATE": eventTypeMetadataUpdated,
+}
+
+// parseEvent decodes a request body holding either a CloudEvent or a GCS
+// notification wrapped in a Pub/Sub push envelope, which is converted to the
+// equivalent CloudEvent.
+func parseEvent(body []byte) (CloudEvent, error) {
+	var push PubSubPushMessage
+	if err := json.Unmarshal(body, &push); err == nil && push.Message.MessageID != "" {
+		var data StorageObjectData
+		if err := json.Unmarshal(push.Message.Data, &data); err != nil {
+			return CloudEvent{}, fmt.Errorf("failed to decode Pub/Sub message data: %w", err)
+		}
+		return CloudEvent{
+			Data:        data,
+			ID:          push.Message.MessageID,
+			Source:      push.Subscription,
+			SpecVersion: "1.0",
+			Type:        pubSubEventTypes[push.Message.Attributes["eventType"]],
+			Time:        push.Message.PublishTime,
+			Subject:     "objects/" + data.Name,
+		}, nil
+	}
+
+	var event CloudEvent
+	err := json.Unmarshal(body, &event)
+	return event, err
+}
+
+// parseEvents decodes a request body holding a single event, as accepted by
+// parseEvent, or a JSON array of them delivered as a batch.
+func parseEvents(body []byte) ([]CloudEvent, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		event, err := parseEvent(body)
+		if err != nil {
+			return nil, err
+		}
+		return []CloudEvent{event}, nil
+	}
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("empty event batch")
+	}
+	events := make([]CloudEvent, 0, len(raw))
+	for _, r := range raw {
+		event, err := parseEvent(r)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// validate checks that the event has the fields processHandler relies on
+// and refers to the files bucket.
+func (e CloudEvent) validate() error {
+	switch {
+	case e.SpecVersion == "":
+		return errors.New("missing specversion")
+	case e.Type == "":
+		return errors.New("missing type")
+	case e.Data.Name == "":
+		return errors.New("missing data.name")
+	case e.Data.Bucket != filesBucketName:
+		return fmt.Errorf("bucket %q is not %q", e.Data.Bucket, filesBucketName)
+	}
+	return nil
+}
 
 func getEnv(key, defaultValue string) string {
 	if v := os.Getenv(key); v != "" {
@@ -62,141 +232,1202 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-func init() {
+// getEnvDuration returns the duration in environment variable key, or
+// defaultValue if it is unset or not a valid non-negative duration.
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		logger.Warn("Invalid duration, using default", "key", key, "value", v, "default", defaultValue.String())
+		return defaultValue
+	}
+	return d
+}
+
+// getEnvInt returns the positive integer in environment variable key, or
+// defaultValue if it is unset or invalid.
+func getEnvInt(key string, defaultValue int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		logger.Warn("Invalid integer, using default", "key", key, "value", v, "default", defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// getEnvBool returns the boolean in environment variable key, or
+// defaultValue if it is unset or invalid.
+func getEnvBool(key string, defaultValue bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logger.Warn("Invalid boolean, using default", "key", key, "value", v, "default", defaultValue)
+		return defaultValue
+	}
+	return b
+}
+
+// processContext returns a context for processing an event or rebuilding
+// the feed. It is detached from the request so the work isn't abandoned if
+// the caller disconnects, and is bounded by PROCESS_TIMEOUT.
+func processContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), processTimeout)
+}
+
+// readContext returns a context for serving a read from GCS, bounded by
+// READ_TIMEOUT.
+func readContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, readTimeout)
+}
+
+// checkConfig exits if the configuration read from the environment is
+// incomplete or invalid, and applies settings that other packages read.
+func checkConfig() {
 	if bucketName == "" {
-		log.Fatal("GCS_BUCKET not set")
+		fatal("GCS_BUCKET not set")
 	}
 
 	if filesBucketName == "" {
-		log.Fatal("GCS_FILES_BUCKET not set")
+		fatal("GCS_FILES_BUCKET not set")
+	}
+
+	if processAudience == "" && processAPIKey == "" {
+		if !allowUnauth {
+			fatal("Neither PROCESS_AUDIENCE nor PROCESS_API_KEY is set; set ALLOW_UNAUTH=true to accept unauthenticated requests")
+		}
+		logger.Warn("ALLOW_UNAUTH set, authenticated endpoints accept unauthenticated requests")
+	}
+
+	if os.Getenv("SHOWS") != "" {
+		for _, s := range shows {
+			if !validShowName(s.Name) {
+				fatal("Invalid show name in SHOWS", "value", s.Name)
+			}
+		}
+	}
+
+	if fileServeMode != "redirect" && fileServeMode != "proxy" {
+		fatal("FILE_SERVE_MODE must be redirect or proxy", "value", fileServeMode)
+	}
+	if pubDateSource != "created" && pubDateSource != "updated" && pubDateSource != "filename" {
+		fatal("PUBDATE_SOURCE must be created, updated or filename", "value", pubDateSource)
+	}
+	if signedURLTTL > 7*24*time.Hour {
+		fatal("SIGNED_URL_TTL must be at most 7 days for V4 signed URLs", "value", signedURLTTL.String())
+	}
+	if signedURLDisp != "" && signedURLDisp != "inline" && signedURLDisp != "attachment" {
+		fatal("SIGNED_URL_DISPOSITION must be inline or attachment", "value", signedURLDisp)
+	}
+
+	// TITLE_STOPWORDS is a comma-separated list replacing the default words
+	// kept in lower case in titles derived from file names.
+	if titleStopwords != "" {
+		episode.Stopwords = nil
+		for _, w := range strings.Split(titleStopwords, ",") {
+			if w = strings.TrimSpace(w); w != "" {
+				episode.Stopwords = append(episode.Stopwords, w)
+			}
+		}
 	}
 
+	if itemTemplatePath != "" {
+		var err error
+		if itemTemplate, err = loadItemTemplate(itemTemplatePath); err != nil {
+			fatal("Invalid ITEM_TEMPLATE", "path", itemTemplatePath, "error", err)
+		}
+	}
+}
+
+// connectStorage creates the GCS client and the stores for the index and
+// files buckets. It runs from main rather than init so the package can be
+// loaded, for example by tests, without credentials or network access;
+// indexStore and filesStore can then be set to any ObjectStore.
+func connectStorage() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	var err error
-	gcsClient, err = storage.NewClient(ctx)
+	gcsClient, err = storage.NewClient(ctx, storageClientOptions()...)
 	if err != nil {
-		log.Fatalf("Failed to create GCS client: %v", err)
+		fatal("Failed to create GCS client", "error", err)
 	}
+	// Retries are handled by withRetry so there is a single, configurable
+	// policy.
+	gcsClient.SetRetry(storage.WithPolicy(storage.RetryNever))
+
+	indexStore = limitedStore{newGCSStore(gcsClient.Bucket(bucketName))}
+	filesStore = limitedStore{newGCSStore(gcsClient.Bucket(filesBucketName))}
 }
 
-func getIndexXML(ctx context.Context) (string, error) {
-	cacheMutex.RLock()
-	if cachedContent != "" && time.Since(cacheTime) < cacheTTL {
-		defer cacheMutex.RUnlock()
-		return cachedContent, nil
+// storageClientOptions returns the options for the GCS client. With
+// GCS_CREDENTIALS_FILE set, the client authenticates with that service
+// account or refresh token file instead of Application Default Credentials.
+// STORAGE_EMULATOR_HOST is handled by the storage package itself, which
+// points the client at the emulator without authentication, so the
+// credentials file is ignored then.
+func storageClientOptions() []option.ClientOption {
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		logger.Info("Using GCS emulator", "host", host)
+		return nil
+	}
+	if path := os.Getenv("GCS_CREDENTIALS_FILE"); path != "" {
+		return []option.ClientOption{option.WithCredentialsFile(path)}
 	}
+	return nil
+}
+
+// indexXML is a copy of index.xml along with the object generation and
+// modification time, which identify its version for conditional requests.
+type indexXML struct {
+	Content    string
+	Generation int64
+	Updated    time.Time
+}
+
+// etag returns the entity tag for this version of index.xml.
+func (x *indexXML) etag() string {
+	return fmt.Sprintf(`"%d"`, x.Generation)
+}
+
+// getIndexXML returns the show's index.xml, cached for up to CACHE_TTL. With
+// CACHE_CHECK_GENERATION set, each cache hit also checks the object's
+// generation, so an update written by another instance is picked up at once.
+func getIndexXML(ctx context.Context, show *Show) (*indexXML, error) {
+	cacheMutex.RLock()
+	cached := show.cached
+	fresh := cached != nil && clock.Now().Sub(show.cacheTime) < cacheTTL
 	cacheMutex.RUnlock()
 
-	reader, err := gcsClient.Bucket(bucketName).Object(indexObject).NewReader(ctx)
-	if err != nil {
-		return "", fmt.Errorf("failed to read index.xml: %w", err)
+	if fresh && (!cacheRevalidate || isCurrent(ctx, show, cached)) {
+		cacheHits.Inc()
+		return cached, nil
 	}
-	defer reader.Close()
+	cacheMisses.Inc()
 
-	content, err := io.ReadAll(reader)
+	content, attrs, err := indexStore.Read(ctx, show.IndexObject)
 	if err != nil {
-		return "", fmt.Errorf("failed to read index.xml content: %w", err)
+		return nil, fmt.Errorf("failed to read %s: %w", show.IndexObject, err)
+	}
+
+	index := &indexXML{
+		Content:    string(content),
+		Generation: attrs.Generation,
+		Updated:    attrs.Updated,
 	}
 
 	cacheMutex.Lock()
-	cachedContent = string(content)
-	cacheTime = time.Now()
+	show.cached = index
+	show.cacheTime = clock.Now()
 	cacheMutex.Unlock()
 
-	return cachedContent, nil
+	return index, nil
+}
+
+// isCurrent reports whether index is still the latest version of the show's
+// index.xml, using a metadata-only request. If the check fails the cached
+// copy is assumed to be current.
+func isCurrent(ctx context.Context, show *Show, index *indexXML) bool {
+	attrs, err := indexStore.Attrs(ctx, show.IndexObject)
+	if err != nil {
+		logger.Warn("Could not check index.xml generation, serving cached copy",
+			"object", show.IndexObject, "error", err)
+		return true
+	}
+	return attrs.Generation == index.Generation
+}
+
+// getFeedPage returns page n of the show's feed, counting from 1. Page 1 is
+// index.xml and is cached; archive pages are read directly. Archive pages
+// are those of the given version, or of the version index.xml links to if
+// it is "".
+func getFeedPage(ctx context.Context, show *Show, n int, version string) (*indexXML, error) {
+	if n == 1 {
+		return getIndexXML(ctx, show)
+	}
+
+	if version == "" {
+		index, err := getIndexXML(ctx, show)
+		if err != nil {
+			return nil, err
+		}
+		feed, err := parseFeed(index.Content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", show.IndexObject, err)
+		}
+		version, _ = nextArchiveVersion(&feed.Channel)
+	}
+
+	name := show.archiveObject(n, version)
+	content, attrs, err := indexStore.Read(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return &indexXML{
+		Content:    string(content),
+		Generation: attrs.Generation,
+		Updated:    attrs.Updated,
+	}, nil
 }
 
-func processFile(ctx context.Context, objectName string) error {
-	log.Println("Starting file processing for %q...", objectName)
+// Errors returned by readFeed when index.xml can't be used and the feed has
+// to be rebuilt from the bucket listing.
+var (
+	errFeedNotFound = errors.New("index.xml not found")
+	errFeedCorrupt  = errors.New("index.xml is corrupt")
+)
+
+// readFeed reads the show's index.xml directly from GCS, bypassing the
+// cache, and returns it parsed along with its generation. Items from the
+// archive pages it links to are merged in, so the result holds the whole
+// feed, and the pages' names are kept in its archives. A missing index.xml
+// returns errFeedNotFound and an unparseable one errFeedCorrupt, the latter
+// along with its generation so the feed can still be replaced.
+func readFeed(ctx context.Context, show *Show) (*RSS, int64, error) {
+	content, attrs, err := indexStore.Read(ctx, show.IndexObject)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, 0, errFeedNotFound
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read %s: %w", show.IndexObject, err)
+	}
+
+	feed, err := decodeFeed(bytes.NewReader(content))
+	if err != nil {
+		return nil, attrs.Generation, fmt.Errorf("%w: %w", errFeedCorrupt, err)
+	}
+
+	for n, page := 2, feed; ; n++ {
+		version, ok := nextArchiveVersion(&page.Channel)
+		if !ok {
+			break
+		}
+		name := show.archiveObject(n, version)
+		content, _, err := indexStore.Read(ctx, name)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if page, err = decodeFeed(bytes.NewReader(content)); err != nil {
+			return nil, 0, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		feed.Channel.Items = append(feed.Channel.Items, page.Channel.Items...)
+		feed.archives = append(feed.archives, name)
+	}
+	feed.Channel.removeLinks("next", "prev")
+
+	return feed, attrs.Generation, nil
+}
+
+// loadFeed returns the show's feed and its generation, ready to be updated.
+// A missing or corrupt index.xml is rebuilt from the files bucket; any other
+// read error is returned so the feed isn't overwritten.
+func loadFeed(ctx context.Context, show *Show) (*RSS, int64, error) {
+	feed, gen, err := readFeed(ctx, show)
+	if errors.Is(err, errFeedNotFound) || errors.Is(err, errFeedCorrupt) {
+		logger.Warn("Could not use existing index.xml, rebuilding from bucket listing",
+			"object", show.IndexObject, "error", err)
+		feed = newFeed()
+		if feed.Channel.Items, err = listItems(ctx, show); err != nil {
+			return nil, 0, err
+		}
+		return feed, gen, nil
+	}
+	// Don't overwrite the feed when it couldn't be read, as that would drop
+	// every episode on a transient failure.
+	return feed, gen, err
+}
+
+// updateFeed applies mutate to the show's current feed and writes the result
+// back to its index.xml. The write is conditional on the generation that was
+// read, so concurrent updates can't silently overwrite each other; on a
+// conflict the feed is re-read and mutate is applied again. If mutate returns
+// false the feed is left unchanged.
+func updateFeed(ctx context.Context, show *Show, mutate func(feed *RSS) bool) error {
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		feed, gen, err := loadFeed(ctx, show)
+		if err != nil {
+			return err
+		}
+
+		if !mutate(feed) {
+			return nil
+		}
+
+		err = writeFeed(ctx, show, feed, gen)
+		if !isPreconditionFailed(err) || attempt == maxWriteAttempts {
+			return err
+		}
+
+		logger.Info("index.xml changed during update, retrying", "attempt", attempt, "wait", backoff.String())
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// previewFeed applies mutate to the show's current feed and returns the
+// index.xml that updateFeed would write, without writing it. It returns ""
+// if mutate leaves the feed unchanged.
+func previewFeed(ctx context.Context, show *Show, mutate func(feed *RSS) bool) (string, error) {
+	feed, _, err := loadFeed(ctx, show)
+	if err != nil {
+		return "", err
+	}
+	if !mutate(feed) {
+		return "", nil
+	}
+	pages, err := renderFeed(show, feed, newArchiveVersion())
+	if err != nil {
+		return "", err
+	}
+	return pages[0], nil
+}
+
+// feedChange is an edit to one show's feed made in response to an event.
+type feedChange struct {
+	show   *Show
+	mutate func(feed *RSS) bool
+	added  bool  // an episode was added or updated, for filesProcessed
+	item   *Item // the added or updated item, if any
+}
+
+// fileChange returns the change that adds or updates the feed item for
+// objectName, or nil if the object isn't an episode. For a sidecar it is the
+// change for the sidecar's episode.
+func fileChange(ctx context.Context, objectName string) (*feedChange, error) {
+	logger.Info("Starting file processing", "object", objectName, "bucket", filesBucketName)
 
 	// Get file metadata from GCS bucket
-	attrs, err := gcsClient.Bucket(filesBucketName).Object(objectName).Attrs(ctx)
+	attrs, err := filesStore.Attrs(ctx, objectName)
 	if err != nil {
-		return fmt.Errorf("error reading object: %w", err)
+		return nil, fmt.Errorf("error reading object: %w", err)
 	}
 
-	if !isAudio(attrs.Name) {
-		return nil
+	show := showFor(attrs.Name)
+	if show != nil && !episode.IsAudio(attrs.Name) {
+		return sidecarChange(ctx, attrs.Name)
+	}
+	if show == nil || excludedFromFeed(attrs) {
+		filesSkipped.Inc()
+		return nil, nil
 	}
 
-	log.Printf("processing object=%q size=%d", attrs.Name, attrs.Size)
+	// Right after a resumable upload is finalized the size can briefly read
+	// as 0, which some clients reject in an enclosure; look once more before
+	// giving up on the object.
+	if attrs.Size == 0 {
+		select {
+		case <-time.After(zeroSizeRecheckDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if attrs, err = filesStore.Attrs(ctx, objectName); err != nil {
+			return nil, fmt.Errorf("error reading object: %w", err)
+		}
+		if attrs.Size == 0 {
+			logger.Warn("Object still has no size, skipping", "object", objectName)
+			filesSkipped.Inc()
+			return nil, nil
+		}
+	}
+
+	if !hasAudioContent(ctx, attrs) {
+		filesSkipped.Inc()
+		return nil, nil
+	}
 
-	title := titleFromName(attrs.Name)
-	date := time.Now().Format("Mon 02 Jan 2006 03:04:05 PM MST")
+	logger.Info("Processing audio file", "object", attrs.Name, "bucket", attrs.Bucket, "size", attrs.Size)
+
+	item := newItem(ctx, attrs, objectExists(ctx))
+
+	mutate := func(feed *RSS) bool {
+		// Eventarc delivers at least once, so replace rather than duplicate
+		// an episode that is already in the feed.
+		if i := feed.Channel.findItem(attrs.Name); i >= 0 {
+			logger.Info("Object already in feed, updating existing item", "object", attrs.Name)
+			feed.Channel.Items[i] = item
+		} else {
+			feed.Channel.Items = append(feed.Channel.Items, item)
+		}
+		return true
+	}
+	return &feedChange{show: show, mutate: mutate, added: true, item: &item}, nil
+}
+
+// removalChange returns the change that deletes the item for objectName, or
+// nil if the object belongs to no show or still exists. In a bucket without
+// versioning, overwriting an object also sends a delete event, which can
+// arrive after the new version's finalize event, so the object is looked up
+// before its item is removed. The same goes for the archive event a bucket
+// with versioning sends instead. Deleting a sidecar updates its episode's
+// item instead.
+func removalChange(ctx context.Context, objectName string) (*feedChange, error) {
+	show := showFor(objectName)
+	if show == nil {
+		logger.Info("Object belongs to no show, nothing to remove", "object", objectName)
+		return nil, nil
+	}
+
+	_, err := filesStore.Attrs(ctx, objectName)
+	if err == nil {
+		logger.Info("Object still exists, not removing from feed", "object", objectName)
+		return nil, nil
+	}
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("error reading object: %w", err)
+	}
+	if !episode.IsAudio(objectName) {
+		return sidecarChange(ctx, objectName)
+	}
+	logger.Info("Removing object from feed", "object", objectName, "feed", show.IndexObject)
+	return &feedChange{show: show, mutate: removeItem(objectName)}, nil
+}
 
-	item := fmt.Sprintf(xmlItemTemplate, title, date, attrs.Name, attrs.Size)
+// removeItem returns a mutation that deletes the item for objectName.
+func removeItem(objectName string) func(feed *RSS) bool {
+	return func(feed *RSS) bool {
+		i := feed.Channel.findItem(objectName)
+		if i < 0 {
+			logger.Info("Object not in feed, nothing to remove", "object", objectName)
+			return false
+		}
+		feed.Channel.Items = append(feed.Channel.Items[:i], feed.Channel.Items[i+1:]...)
+		return true
+	}
+}
 
-	// Read existing index.xml
-	existingContent, err := getIndexXML(ctx)
+// metadataChange returns the change for an episode whose custom metadata
+// was edited, which can change its title and keywords or exclude it from
+// the feed. An item already in the feed is regenerated, or removed if the
+// object is now marked skip-feed. Episodes not in the feed are left out of
+// it, as they were skipped or haven't been processed yet.
+func metadataChange(ctx context.Context, objectName string) (*feedChange, error) {
+	attrs, err := filesStore.Attrs(ctx, objectName)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		logger.Info("Object no longer exists, ignoring metadata update", "object", objectName)
+		return nil, nil
+	}
 	if err != nil {
-		log.Printf("Warning: Could not read existing index.xml, starting fresh: %v", err)
-		existingContent = ""
+		return nil, fmt.Errorf("error reading object: %w", err)
 	}
 
-	// Remove closing tags from existing content
-	if existingContent != "" {
-		existingContent = strings.TrimSuffix(existingContent, "</channel>\n</rss>\n")
-		existingContent = strings.TrimSuffix(existingContent, "</channel>\n")
-		existingContent = strings.TrimSuffix(existingContent, "</rss>\n")
+	show := showFor(attrs.Name)
+	if show == nil || !episode.IsAudio(attrs.Name) {
+		return nil, nil
+	}
+	if excludedFromFeed(attrs) {
+		logger.Info("Object marked skip-feed, removing from feed", "object", attrs.Name, "feed", show.IndexObject)
+		return &feedChange{show: show, mutate: removeItem(attrs.Name)}, nil
 	}
 
-	// Build new content
-	var buf bytes.Buffer
-	if existingContent != "" {
-		buf.WriteString(existingContent)
+	// The item is only built once it is known to be in the feed, and is
+	// kept across retries of the update.
+	var item *Item
+	mutate := func(feed *RSS) bool {
+		i := feed.Channel.findItem(attrs.Name)
+		if i < 0 {
+			logger.Info("Object not in feed, ignoring metadata update", "object", attrs.Name)
+			return false
+		}
+		if item == nil {
+			it := newItem(ctx, attrs, objectExists(ctx))
+			item = &it
+		}
+		feed.Channel.Items[i] = *item
+		return true
 	}
+	return &feedChange{show: show, mutate: mutate}, nil
+}
 
-	buf.WriteString(item)
-	buf.WriteString("\n")
-	buf.WriteString("</channel>\n</rss>\n")
+// sidecarChange returns the change that regenerates the item for the episode
+// objectName is a sidecar of, such as ep1.mp3 for ep1.jpg, so that sidecars
+// uploaded or deleted after their episode reach the feed. It returns nil if
+// objectName isn't a sidecar or there is no such episode.
+func sidecarChange(ctx context.Context, objectName string) (*feedChange, error) {
+	base, ok := sidecarBase(objectName)
+	if !ok {
+		filesSkipped.Inc()
+		return nil, nil
+	}
 
-	newContent := buf.String()
+	objects, err := filesStore.List(ctx, base+".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	for _, attrs := range objects {
+		if episode.IsAudio(attrs.Name) && strings.TrimSuffix(attrs.Name, filepath.Ext(attrs.Name)) == base {
+			logger.Info("Sidecar changed, updating its episode", "object", objectName, "episode", attrs.Name)
+			return fileChange(ctx, attrs.Name)
+		}
+	}
+	logger.Info("No episode for sidecar", "object", objectName)
+	filesSkipped.Inc()
+	return nil, nil
+}
 
-	// Write back to GCS
-	writer := gcsClient.Bucket(bucketName).Object(indexObject).NewWriter(ctx)
-	writer.ContentType = "application/rss+xml; charset=utf-8"
+// applyChanges makes changes with a single read-modify-write of each show's
+// feed. In a dry run nothing is written and the index.xml that would have
+// been is returned instead, or the last one if several shows change.
+func applyChanges(ctx context.Context, changes []*feedChange, dryRun bool) (string, error) {
+	var preview string
+	for _, show := range shows {
+		var mutates []func(feed *RSS) bool
+		var item *Item
+		added := 0
+		for _, c := range changes {
+			if c.show == show {
+				mutates = append(mutates, c.mutate)
+				item = c.item
+				if c.added {
+					added++
+				}
+			}
+		}
+		if len(mutates) == 0 {
+			continue
+		}
+
+		mutate := func(feed *RSS) bool {
+			changed := false
+			for _, m := range mutates {
+				changed = m(feed) || changed
+			}
+			return changed
+		}
+
+		if dryRun {
+			p, err := previewFeed(ctx, show, mutate)
+			if err != nil {
+				return "", err
+			}
+			if p != "" {
+				preview = p
+			}
+			continue
+		}
+
+		// A single new or updated episode is inserted into index.xml as it
+		// streams past, so large feeds aren't parsed in full.
+		if len(mutates) == 1 && item != nil {
+			err := streamItem(ctx, show, *item)
+			if err == nil {
+				filesProcessed.Add(float64(added))
+				continue
+			}
+			if !errors.Is(err, errCannotStream) {
+				return "", err
+			}
+			logger.Debug("Updating feed in full", "feed", show.IndexObject, "reason", err)
+		}
+
+		if err := updateFeed(ctx, show, mutate); err != nil {
+			return "", err
+		}
+		filesProcessed.Add(float64(added))
+	}
+	return preview, nil
+}
+
+// processFile adds or updates the feed item for objectName. In a dry run the
+// feed isn't written; the index.xml that would have been is returned instead.
+func processFile(ctx context.Context, objectName string, dryRun bool) (string, error) {
+	change, err := fileChange(ctx, objectName)
+	if err != nil || change == nil {
+		return "", err
+	}
+	return applyChanges(ctx, []*feedChange{change}, dryRun)
+}
+
+// newItem builds the feed item for an audio object. Title, author,
+// description and duration come from the file's embedded metadata when it has
+// them, with the title otherwise derived from the object name. A title set in
+// the object's custom metadata overrides both. A show notes sidecar overrides
+// the description, which falls back to the title. exists reports whether a
+// sidecar object is present in the files bucket.
+func newItem(ctx context.Context, attrs *storage.ObjectAttrs, exists func(name string) bool) Item {
+	item := Item{
+		Title:   titleFromName(attrs.Name),
+		PubDate: formatPubDate(pubDateFor(attrs)),
+		GUID:    guidFor(attrs.Name),
+		Enclosure: Enclosure{
+			URL:    fileURL(attrs.Name),
+			Length: attrs.Size,
+			Type:   enclosureType(attrs),
+		},
+	}
+
+	// A gzip-encoded object is stored compressed, but clients following the
+	// enclosure are served the decompressed file, so that is the length to
+	// advertise. Its tags can't be read without decompressing it either.
+	var info AudioInfo
+	if attrs.ContentEncoding == "gzip" {
+		if size, err := decompressedSize(ctx, attrs.Name); err != nil {
+			logger.Warn("Could not measure gzip-encoded object", "object", attrs.Name, "error", err)
+		} else {
+			item.Enclosure.Length = size
+		}
+	} else {
+		r := objectReaderAt{ctx: ctx, store: filesStore, name: attrs.Name, size: attrs.Size}
+		var err error
+		if info, err = readAudioInfo(r, attrs.Size, attrs.Name); err != nil {
+			logger.Warn("Could not read audio metadata", "object", attrs.Name, "error", err)
+		}
+	}
+	if title := attrs.Metadata["title"]; title != "" {
+		item.Title = title
+	} else if info.Title != "" {
+		item.Title = info.Title
+	}
+	item.ITunesAuthor = info.Artist
+	if info.Duration > 0 {
+		item.ITunesDuration = formatDuration(info.Duration)
+	}
+
+	if image := findSidecar(attrs.Name, artworkExts, exists); image != "" {
+		item.ITunesImage = &ITunesImage{Href: fileURL(image)}
+	}
+
+	description := info.Comment
+	if notes := findSidecar(attrs.Name, notesExts, exists); notes != "" {
+		content, _, err := filesStore.Read(ctx, notes)
+		if err != nil {
+			logger.Warn("Could not read episode notes", "object", notes, "error", err)
+		} else if text := strings.TrimSpace(string(content)); text != "" {
+			description = text
+		}
+	}
+	if description == "" {
+		description = item.Title
+	}
+	item.Description = &CDATA{Text: description}
+	item.ITunesSummary = &CDATA{Text: description}
+
+	item.ITunesSeason, item.ITunesEpisode = episode.Numbers(attrs.Name)
+	item.ITunesKeywords = keywordsFrom(attrs)
+
+	if transcript := findSidecar(attrs.Name, transcriptExts, exists); transcript != "" {
+		item.Transcript = &Transcript{
+			URL:  fileURL(transcript),
+			Type: transcriptTypes[filepath.Ext(transcript)],
+		}
+	}
+	if chapters := findSidecar(attrs.Name, chaptersExts, exists); chapters != "" {
+		item.Chapters = &Chapters{URL: fileURL(chapters), Type: "application/json+chapters"}
+	}
+
+	if itemTemplate != nil {
+		extra, err := renderItemTemplate(itemTemplate, ItemTemplateData{
+			Title:    item.Title,
+			PubDate:  item.PubDate,
+			FileName: filepath.Base(attrs.Name),
+			Size:     item.Enclosure.Length,
+			Type:     item.Enclosure.Type,
+			GUID:     item.GUID.Value,
+		})
+		if err != nil {
+			logger.Warn("Could not render ITEM_TEMPLATE", "object", attrs.Name, "error", err)
+		} else {
+			item.Extra = extra
+		}
+	}
+
+	// An empty ep1.explicit or ep1.clean object next to ep1.mp3 overrides
+	// the channel's FEED_EXPLICIT setting for that episode.
+	switch {
+	case findSidecar(attrs.Name, explicitExts, exists) != "":
+		item.ITunesExplicit = "true"
+	case findSidecar(attrs.Name, cleanExts, exists) != "":
+		item.ITunesExplicit = "false"
+	}
+
+	return item
+}
+
+// artworkExts are the extensions of per-episode artwork stored next to the
+// audio file, e.g. ep1.jpg for ep1.mp3.
+var artworkExts = []string{".jpg", ".jpeg", ".png"}
+
+// notesExts are the extensions of per-episode show notes stored next to the
+// audio file, e.g. ep1.txt for ep1.mp3. They become the item's description.
+var notesExts = []string{".txt", ".md"}
+
+// transcriptExts are the extensions of per-episode transcripts stored next
+// to the audio file, e.g. ep1.vtt for ep1.mp3.
+var transcriptExts = []string{".vtt", ".srt"}
 
-	_, err = io.WriteString(writer, newContent)
+// transcriptTypes maps transcript extensions to their MIME types.
+var transcriptTypes = map[string]string{
+	".vtt": "text/vtt",
+	".srt": "application/x-subrip",
+}
+
+// chaptersExts, explicitExts and cleanExts are the suffixes of the chapters,
+// explicit and clean sidecars, e.g. ep1.chapters.json for ep1.mp3.
+var (
+	chaptersExts = []string{".chapters.json"}
+	explicitExts = []string{".explicit"}
+	cleanExts    = []string{".clean"}
+)
+
+// sidecarExts are the suffixes of every kind of sidecar object.
+var sidecarExts = slices.Concat(artworkExts, notesExts, transcriptExts, chaptersExts, explicitExts, cleanExts)
+
+// sidecarBase returns objectName without its sidecar suffix, which is also
+// the name of its episode without the audio extension. It returns false if
+// objectName isn't a sidecar.
+func sidecarBase(objectName string) (string, bool) {
+	for _, ext := range sidecarExts {
+		if base, ok := strings.CutSuffix(objectName, ext); ok && base != "" && !strings.HasSuffix(base, "/") {
+			return base, true
+		}
+	}
+	return "", false
+}
+
+// findSidecar returns the name of the first object that shares objectName's
+// base name and has one of exts, or "" if exists reports none of them.
+func findSidecar(objectName string, exts []string, exists func(name string) bool) string {
+	base := strings.TrimSuffix(objectName, filepath.Ext(objectName))
+	for _, ext := range exts {
+		if name := base + ext; exists(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// objectExists returns a function that checks for an object in the files
+// bucket with an Attrs call.
+func objectExists(ctx context.Context) func(name string) bool {
+	return func(name string) bool {
+		_, err := filesStore.Attrs(ctx, name)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			logger.Warn("Could not check for sidecar object", "object", name, "error", err)
+		}
+		return err == nil
+	}
+}
+
+// rebuildFeed replaces every item in each show's index.xml with items
+// generated from a listing of the files bucket. Channel metadata in the
+// existing feeds is kept. It returns the number of items written.
+func rebuildFeed(ctx context.Context) (int, error) {
+	total := 0
+	for _, show := range shows {
+		logger.Info("Rebuilding feed from bucket listing", "bucket", filesBucketName, "prefix", show.Prefix)
+
+		items, err := listItems(ctx, show)
+		if err != nil {
+			return total, err
+		}
+
+		err = updateFeed(ctx, show, func(feed *RSS) bool {
+			feed.Channel.Items = items
+			return true
+		})
+		if err != nil {
+			return total, err
+		}
+		total += len(items)
+	}
+	return total, nil
+}
+
+// reindexShow reconciles the show's feed with the files bucket: items whose
+// episode is no longer in the bucket are removed and episodes missing from
+// the feed are added, while the rest of the feed is left as it is. It
+// returns the object names added and the GUIDs of the items removed.
+func reindexShow(ctx context.Context, show *Show) (added, removed []string, err error) {
+	objects, err := filesStore.List(ctx, show.Prefix)
 	if err != nil {
-		writer.Close()
-		return fmt.Errorf("failed to write index.xml: %w", err)
+		return nil, nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	listed := make(map[string]bool, len(objects))
+	for _, attrs := range objects {
+		listed[attrs.Name] = true
 	}
+	exists := func(name string) bool { return listed[name] }
 
-	if err := writer.Close(); err != nil {
-		return fmt.Errorf("failed to close writer: %w", err)
+	// Items are matched to episodes the same way findItem does, on GUID or
+	// enclosure URL.
+	var episodes []*storage.ObjectAttrs
+	backed := make(map[string]bool)
+	for _, attrs := range objects {
+		if showFor(attrs.Name) == show && episode.IsAudio(attrs.Name) && !excludedFromFeed(attrs) {
+			episodes = append(episodes, attrs)
+			backed[guidFor(attrs.Name).Value] = true
+			backed[fileURL(attrs.Name)] = true
+		}
 	}
 
+	// New items are kept across retries of the update so each episode's
+	// metadata is only read once.
+	built := make(map[string]Item)
+	err = updateFeed(ctx, show, func(feed *RSS) bool {
+		added, removed = nil, nil
+
+		items := feed.Channel.Items[:0]
+		for _, item := range feed.Channel.Items {
+			if backed[item.GUID.Value] || backed[item.Enclosure.URL] {
+				items = append(items, item)
+				continue
+			}
+			id := item.GUID.Value
+			if id == "" {
+				id = item.Enclosure.URL
+			}
+			removed = append(removed, id)
+		}
+		feed.Channel.Items = items
+
+		for _, attrs := range episodes {
+			if feed.Channel.findItem(attrs.Name) >= 0 {
+				continue
+			}
+			item, ok := built[attrs.Name]
+			if !ok {
+				if !hasAudioContent(ctx, attrs) {
+					continue
+				}
+				item = newItem(ctx, attrs, exists)
+				built[attrs.Name] = item
+			}
+			feed.Channel.Items = append(feed.Channel.Items, item)
+			added = append(added, attrs.Name)
+		}
+		return len(added) > 0 || len(removed) > 0
+	})
+	return added, removed, err
+}
+
+// listItems builds an item for every audio file of the show in the files
+// bucket. The attributes and sidecars come from a single listing rather than
+// an Attrs call per object. Should two objects yield the same GUID, only the
+// newer item is kept.
+func listItems(ctx context.Context, show *Show) ([]Item, error) {
+	objects, err := filesStore.List(ctx, show.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	listed := make(map[string]bool, len(objects))
+	for _, attrs := range objects {
+		listed[attrs.Name] = true
+	}
+	exists := func(name string) bool { return listed[name] }
+
+	var items []Item
+	for _, attrs := range objects {
+		if showFor(attrs.Name) == show && episode.IsAudio(attrs.Name) && !excludedFromFeed(attrs) && hasAudioContent(ctx, attrs) {
+			items = append(items, newItem(ctx, attrs, exists))
+		}
+	}
+	return dedupeItems(items), nil
+}
+
+// removeFile deletes the item for objectName from its show's index.xml, if
+// present. In a dry run the feed isn't written; the index.xml that would have
+// been is returned instead.
+func removeFile(ctx context.Context, objectName string, dryRun bool) (string, error) {
+	change, err := removalChange(ctx, objectName)
+	if err != nil || change == nil {
+		return "", err
+	}
+	return applyChanges(ctx, []*feedChange{change}, dryRun)
+}
+
+// renderFeed applies the configured channel metadata, sorts feed and
+// marshals it. When FEED_MAX_ITEMS is set, only the newest items go on the
+// first page, which is index.xml, and the rest go on archive pages of the
+// given version.
+func renderFeed(show *Show, feed *RSS, version string) ([]string, error) {
+	feed.ITunesNS = itunesNamespace
+	feed.AtomNS = atomNamespace
+	feed.PodcastNS = podcastNamespace
+	applyChannelConfig(&feed.Channel, show)
+	feed.Channel.sortItems()
+
+	var pages []string
+	pageURL := func(n int) string { return show.pageURL(n, version) }
+	for _, page := range feed.paginate(feedMaxItems, pageURL) {
+		content, err := page.marshal()
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, content)
+	}
+	return pages, nil
+}
+
+// writeFeed renders feed and writes it to the show's index.xml and archive
+// pages, then clears the show's cache. The archive pages are written first
+// under a new version, so the index.xml write switches readers to the new
+// set of pages at once; if it fails, the new pages are deleted, and if it
+// succeeds, the pages feed was read from are. The index.xml write only
+// succeeds if it is still at generation gen, where 0 means it must not exist
+// yet.
+func writeFeed(ctx context.Context, show *Show, feed *RSS, gen int64) error {
+	version := newArchiveVersion()
+	pages, err := renderFeed(show, feed, version)
+	if err != nil {
+		return err
+	}
+
+	// Check what is about to be published, so a bad render leaves the
+	// current feed in place.
+	for i, content := range pages {
+		if err := validateFeed(content); err != nil {
+			return fmt.Errorf("page %d of %s is invalid: %w", i+1, show.IndexObject, err)
+		}
+	}
+
+	if err := checkWriteTime(ctx, show); err != nil {
+		return err
+	}
+
+	var archives []string
+	for i, content := range pages[1:] {
+		name := show.archiveObject(i+2, version)
+		err := indexStore.Write(ctx, name, feedContentType, []byte(content), storage.Conditions{DoesNotExist: true})
+		if err != nil {
+			deleteArchives(ctx, archives)
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		archives = append(archives, name)
+	}
+
+	cond := storage.Conditions{GenerationMatch: gen}
+	if gen == 0 {
+		cond = storage.Conditions{DoesNotExist: true}
+	}
+	// Write back to GCS
+	if err := writeIndexAtomically(ctx, show.IndexObject, []byte(pages[0]), cond); err != nil {
+		deleteArchives(ctx, archives)
+		return fmt.Errorf("failed to write %s: %w", show.IndexObject, err)
+	}
+	deleteArchives(ctx, feed.archives)
+
+	logger.Info("Updated index.xml", "object", show.IndexObject, "bucket", bucketName,
+		"items", len(feed.Channel.Items), "pages", len(pages))
+	feedUpdated(ctx, show)
+	return nil
+}
+
+// checkWriteTime returns an error if there is too little time left before
+// ctx's deadline to start writing the show's feed.
+func checkWriteTime(ctx context.Context, show *Show) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("not writing %s: %w", show.IndexObject, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < minWriteTime {
+		return fmt.Errorf("not writing %s: only %s left before deadline", show.IndexObject, time.Until(deadline).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// feedUpdated clears the show's cache and tells the WebSub hub, after its
+// index.xml has been written.
+func feedUpdated(ctx context.Context, show *Show) {
 	// Clear cache
 	cacheMutex.Lock()
-	cachedContent = ""
+	show.cached = nil
 	cacheMutex.Unlock()
 
-	log.Printf("Updated index.xml")
-	return nil
+	if err := notifyHub(ctx, show.FeedURL); err != nil {
+		logger.Warn("Failed to notify WebSub hub", "hub", websubHub, "feed", show.FeedURL, "error", err)
+	}
+}
+
+// feedContentType is the Content-Type of index.xml and its archive pages.
+const feedContentType = "application/rss+xml; charset=utf-8"
+
+// writeIndexAtomically writes content to a temporary object and then copies
+// it over name, subject to cond, so readers of name only ever see a complete
+// feed.
+func writeIndexAtomically(ctx context.Context, name string, content []byte, cond storage.Conditions) error {
+	return replaceAtomically(ctx, name, cond, func(tmp string) error {
+		return indexStore.Write(ctx, tmp, feedContentType, content, storage.Conditions{DoesNotExist: true})
+	})
+}
+
+// replaceAtomically has write create a temporary object and then copies it
+// over name, subject to cond. The temporary name is unique to this write so
+// concurrent updates can't publish each other's content. The temporary
+// object is deleted afterwards, whether or not write succeeded.
+func replaceAtomically(ctx context.Context, name string, cond storage.Conditions, write func(tmp string) error) error {
+	tmp := fmt.Sprintf("%s.tmp-%d", name, time.Now().UnixNano())
+	defer func() {
+		err := indexStore.Delete(context.WithoutCancel(ctx), tmp)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			logger.Warn("Failed to delete temporary feed object", "object", tmp, "error", err)
+		}
+	}()
+	if err := write(tmp); err != nil {
+		return err
+	}
+	return indexStore.Copy(ctx, tmp, name, cond)
+}
+
+// deleteArchives deletes archive pages that no index.xml links to any more.
+// Failures are only logged, as the pages are no longer read.
+func deleteArchives(ctx context.Context, names []string) {
+	ctx = context.WithoutCancel(ctx)
+	for _, name := range names {
+		if err := indexStore.Delete(ctx, name); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			logger.Warn("Failed to delete archive page", "object", name, "error", err)
+		}
+	}
+}
+
+// applyChannelConfig sets the channel metadata configured through the
+// environment for show. The image and category are left as they are when
+// not configured; the WebSub hub link is removed when WEBSUB_HUB is unset.
+// The atom self link points at the show's public feed URL.
+func applyChannelConfig(c *Channel, show *Show) {
+	c.Title = show.Title
+	c.Link = feedLink
+	c.Description = feedDescription
+	c.ITunesAuthor = feedAuthor
+	c.Language = feedLanguage
+	c.ITunesExplicit = strconv.FormatBool(feedExplicit)
+	if feedImageURL != "" {
+		c.Image = &Image{URL: feedImageURL, Title: show.Title, Link: feedLink}
+		c.ITunesImage = &ITunesImage{Href: feedImageURL}
+	}
+	if feedCategory != "" {
+		c.ITunesCategory = &ITunesCategory{Text: feedCategory}
+	}
+	c.removeLinks("self", "hub")
+	c.AtomLinks = append(c.AtomLinks, AtomLink{Href: show.FeedURL, Rel: "self", Type: "application/rss+xml"})
+	if websubHub != "" {
+		c.AtomLinks = append(c.AtomLinks, AtomLink{Href: websubHub, Rel: "hub"})
+	}
+}
+
+// isPreconditionFailed reports whether err is a GCS precondition failure,
+// i.e. index.xml was modified since it was read.
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+// excludedFromFeed reports whether an object was uploaded with the custom
+// metadata skip-feed: true (x-goog-meta-skip-feed) to keep it out of the
+// feed.
+func excludedFromFeed(attrs *storage.ObjectAttrs) bool {
+	skip, _ := strconv.ParseBool(attrs.Metadata["skip-feed"])
+	return skip
+}
+
+// keywordsFrom returns the comma-separated keywords set as the custom
+// metadata keywords (x-goog-meta-keywords), trimmed and with empty entries
+// dropped.
+func keywordsFrom(attrs *storage.ObjectAttrs) string {
+	var keywords []string
+	for _, k := range strings.Split(attrs.Metadata["keywords"], ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keywords = append(keywords, k)
+		}
+	}
+	return strings.Join(keywords, ",")
 }
 
-func isAudio(name string) bool {
-	n := strings.ToLower(name)
-	return strings.HasSuffix(n, ".mp3") || strings.HasSuffix(n, ".m4a")
+// hasAudioContent reports whether an audio file's content matches its
+// extension. The check costs a read, so it only runs when VERIFY_AUDIO_MAGIC
+// is set; otherwise every file passes, as do gzip-encoded files.
+func hasAudioContent(ctx context.Context, attrs *storage.ObjectAttrs) bool {
+	if !verifyAudioMagic || attrs.ContentEncoding == "gzip" {
+		return true
+	}
+	r := objectReaderAt{ctx: ctx, store: filesStore, name: attrs.Name, size: attrs.Size}
+	if !hasAudioMagic(r, attrs.Name) {
+		logger.Warn("Skipping file whose content doesn't match its extension", "object", attrs.Name)
+		return false
+	}
+	return true
 }
 
+// decompressedSize returns the size of a gzip-encoded object once
+// decompressed, by reading it in full.
+func decompressedSize(ctx context.Context, name string) (int64, error) {
+	reader, err := filesStore.NewRangeReader(ctx, name, 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(io.Discard, gz)
+}
+
+// enclosureType returns the MIME type for an object, preferring the
+// Content-Type stored in GCS when it names an audio type and otherwise
+// falling back to the file extension.
+func enclosureType(attrs *storage.ObjectAttrs) string {
+	if ct, _, _ := strings.Cut(attrs.ContentType, ";"); strings.HasPrefix(ct, "audio/") {
+		return strings.TrimSpace(ct)
+	}
+	return episode.MIMEType(attrs.Name)
+}
+
+// titleFromName derives an episode title from its object name. When the
+// pubDate comes from the name, the date is left out of the title.
 func titleFromName(name string) string {
-	base := filepath.Base(name)
-	title := strings.TrimSuffix(base, filepath.Ext(base))
-	return sanitizeTitle(title)
+	if pubDateSource == "filename" {
+		if _, rest, ok := episode.DatePrefix(name); ok && strings.TrimSuffix(rest, filepath.Ext(rest)) != "" {
+			return episode.Title(rest)
+		}
+	}
+	return episode.Title(name)
 }
 
-func sanitizeTitle(s string) string {
-	// Replace underscores and digits with spaces
-	for i := 0; i < len(s); i++ {
-		if s[i] == '_' || (s[i] >= '0' && s[i] <= '9') {
-			s = s[:i] + " " + s[i+1:]
+// pubDateFor returns the publication date of an episode, taken from the
+// source chosen by PUBDATE_SOURCE. With "filename", names without a date
+// fall back to the creation time.
+func pubDateFor(attrs *storage.ObjectAttrs) time.Time {
+	switch pubDateSource {
+	case "updated":
+		return attrs.Updated
+	case "filename":
+		if date, _, ok := episode.DatePrefix(attrs.Name); ok {
+			return date
 		}
+		logger.Warn("No date at start of object name, using creation time", "object", attrs.Name)
 	}
-	// Trim spaces
-	return strings.TrimSpace(s)
+	return attrs.Created
+}
+
+// writeError writes a JSON error response. code is a stable identifier for
+// the kind of error that clients can match on; message is for people.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}{message, code})
+}
+
+// notFoundHandler answers requests for paths no other route matches.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, "not_found", "Not found")
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -204,37 +1435,161 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, `{"status":"ok"}`)
 }
 
+// readyHandler reports whether GCS is reachable, so Cloud Run only routes
+// traffic to instances that can serve the feed. A missing index.xml still
+// counts as ready.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	_, err := indexStore.Attrs(ctx, shows[0].IndexObject)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		logger.Warn("Readiness check failed", "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, `{"status":"unavailable"}`)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"status":"ready"}`)
+}
+
 func feedHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	feedRequests.Inc()
+
+	show := showNamed(r.PathValue("show"))
+	if show == nil {
+		notFoundHandler(w, r)
+		return
+	}
+
+	page := 1
+	if p := r.URL.Query().Get("page"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "invalid_page", "Invalid page")
+			return
+		}
+		page = n
+	}
+
+	ctx, cancel := readContext(context.Background())
 	defer cancel()
 
-	content, err := getIndexXML(ctx)
+	index, err := getFeedPage(ctx, show, page, r.URL.Query().Get("v"))
+	if page > 1 && errors.Is(err, storage.ErrObjectNotExist) {
+		writeError(w, http.StatusNotFound, "page_not_found", "Page not found")
+		return
+	}
 	if err != nil {
-		log.Printf("Error fetching index.xml: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"error":"Failed to fetch podcast feed"}`)
+		logger.Error("Error fetching index.xml", "page", page, "error", err)
+		writeError(w, http.StatusInternalServerError, "feed_read_failed", "Failed to fetch podcast feed")
+		return
+	}
+
+	etag := index.etag()
+	w.Header().Set("ETag", etag)
+	if !index.Updated.IsZero() {
+		w.Header().Set("Last-Modified", index.Updated.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, index.Updated) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
+	// withGzip drops Content-Length when it compresses the response.
 	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
-	fmt.Fprint(w, content)
+	w.Header().Set("Content-Length", strconv.Itoa(len(index.Content)))
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	io.WriteString(w, index.Content)
 }
 
-func fileHandler(w http.ResponseWriter, r *http.Request) {
+// notModified reports whether the request's conditional headers show the
+// client already has this version of the feed. If-None-Match takes precedence
+// over If-Modified-Since when both are sent.
+func notModified(r *http.Request, etag string, updated time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || updated.IsZero() {
+		return false
+	}
+	// HTTP dates have one-second resolution.
+	return !updated.Truncate(time.Second).After(ims)
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// weak comparison. The ETag of the gzip-compressed form of the response
+// matches too, as the content is the same.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if c, ok := strings.CutSuffix(candidate, gzipETagSuffix+`"`); ok {
+			candidate = c + `"`
+		}
+		if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// fileObjectName returns the files bucket object named by the request's
+// {file} path value. If the name is invalid it writes a 400 response and
+// returns false.
+func fileObjectName(w http.ResponseWriter, r *http.Request) (string, bool) {
 	filename := r.PathValue("file")
+	if !validObjectName(filename) {
+		logger.Warn("Rejected invalid file name", "object", filename)
+		writeError(w, http.StatusBadRequest, "invalid_file_name", "Invalid file name")
+		return "", false
+	}
+	return filesPrefix + filename, true
+}
 
-	// Generate a signed URL for the GCS object
-	url, err := gcsClient.Bucket(filesBucketName).SignedURL(filename, &storage.SignedURLOptions{
-		Method:  http.MethodGet,
-		Expires: time.Now().Add(15 * time.Minute), // URL valid for 15 minutes
-	})
+func fileHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := fileObjectName(w, r)
+	if !ok {
+		return
+	}
 
+	if fileServeMode == "proxy" {
+		proxyFile(w, r, filename)
+		return
+	}
+
+	ctx, cancel := readContext(r.Context())
+	defer cancel()
+
+	// Signing doesn't check the object exists, so look it up first rather
+	// than redirecting to a URL that 404s at GCS.
+	attrs, err := filesStore.Attrs(ctx, filename)
 	if err != nil {
-		log.Printf("Error generating signed URL for %s: %v", filename, err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"error":"Failed to generate signed URL for podcast file"}`)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			writeError(w, http.StatusNotFound, "file_not_found", "File not found")
+			return
+		}
+		logger.Error("Error reading file attributes", "object", filename, "error", err)
+		writeError(w, http.StatusInternalServerError, "file_read_failed", "Failed to read podcast file")
+		return
+	}
+
+	redirectToSignedURL(w, r, attrs)
+}
+
+// redirectToSignedURL redirects the client to a signed URL for the object.
+func redirectToSignedURL(w http.ResponseWriter, r *http.Request, attrs *storage.ObjectAttrs) {
+	// Generate a signed URL for the GCS object
+	url, err := filesStore.SignedURL(attrs.Name, signedURLOptions(attrs))
+	if err != nil {
+		logger.Error("Error generating signed URL", "object", attrs.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, "signing_failed", "Failed to generate signed URL for podcast file")
 		return
 	}
 
@@ -242,75 +1597,318 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
+// signedURLOptions returns the options for signing a download URL for the
+// object. With SIGNED_URL_DISPOSITION set, GCS is asked to serve it with that
+// Content-Disposition and the episode's enclosure type, so browsers save it
+// under its own file name.
+func signedURLOptions(attrs *storage.ObjectAttrs) *storage.SignedURLOptions {
+	// Without a private key, BucketHandle.SignedURL signs through the IAM
+	// signBlob API as the default service account, as on Cloud Run.
+	opts := &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  http.MethodGet,
+		Expires: clock.Now().Add(signedURLTTL),
+	}
+	if signedURLDisp != "" {
+		opts.QueryParameters = url.Values{
+			"response-content-disposition": {mime.FormatMediaType(signedURLDisp, map[string]string{"filename": filepath.Base(attrs.Name)})},
+			"response-content-type":        {enclosureType(attrs)},
+		}
+	}
+	return opts
+}
+
+// itemHandler returns the feed item for one file as an XML fragment,
+// regenerated from the object rather than read from the feed.
+func itemHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := fileObjectName(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := readContext(r.Context())
+	defer cancel()
+
+	attrs, err := filesStore.Attrs(ctx, filename)
+	if errors.Is(err, storage.ErrObjectNotExist) || (err == nil && !episode.IsAudio(attrs.Name)) {
+		writeError(w, http.StatusNotFound, "file_not_found", "File not found")
+		return
+	}
+	if err != nil {
+		logger.Error("Error reading file attributes", "object", filename, "error", err)
+		writeError(w, http.StatusInternalServerError, "file_read_failed", "Failed to read podcast file")
+		return
+	}
+
+	item := newItem(ctx, attrs, objectExists(ctx))
+
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.EncodeElement(item, xml.StartElement{Name: xml.Name{Local: "item"}}); err != nil {
+		logger.Error("Error encoding item", "object", filename, "error", err)
+		writeError(w, http.StatusInternalServerError, "item_encode_failed", "Failed to encode item")
+		return
+	}
+	buf.WriteString("\n")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	buf.WriteTo(w)
+}
+
+// validObjectName reports whether name is safe to look up in the files
+// bucket: it must be relative and contain no "." or ".." segments.
+func validObjectName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteFileHandler deletes an episode's object from the files bucket and
+// removes its item from the feed. Deleting an object that is already gone
+// still removes the item.
+func deleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	filename, ok := fileObjectName(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := processContext()
+	defer cancel()
+
+	err := filesStore.Delete(ctx, filename)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		logger.Error("Error deleting file", "object", filename, "error", err)
+		writeError(w, http.StatusInternalServerError, "delete_failed", "Failed to delete file")
+		return
+	}
+
+	if _, err := removeFile(ctx, filename, false); err != nil {
+		logger.Error("Error removing file from feed", "object", filename, "error", err)
+		writeError(w, http.StatusInternalServerError, "feed_update_failed", "Failed to remove file from feed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"status":"deleted"}`)
+}
+
 func processHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 55*time.Minute)
+	start := time.Now()
+	ctx, cancel := processContext()
 	defer cancel()
 
 	// Decode the Eventarc trigger payload
 	body, err := io.ReadAll(r.Body)
 	defer r.Body.Close() // Ensure body is closed
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"error":"Failed to read request body"}`)
+		logger.Error("Error reading request body", "error", err)
+		writeError(w, http.StatusInternalServerError, "body_read_failed", "Failed to read request body")
 		return
 	}
 
-	var event CloudEvent
-	err = json.Unmarshal(body, &event)
+	events, err := parseEvents(body)
 	if err != nil {
-		log.Printf("Error unmarshalling event payload: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"error":"Failed to parse event payload"}`)
+		logger.Warn("Error unmarshalling event payload", "error", err)
+		writeError(w, http.StatusBadRequest, "invalid_payload", "Failed to parse event payload")
 		return
 	}
+	logger.Debug("Parsed event payload", "events", len(events), "body", string(body))
+
+	for _, event := range events {
+		if err := event.validate(); err != nil {
+			logger.Warn("Invalid event payload", "error", err)
+			writeError(w, http.StatusBadRequest, "invalid_event", "Invalid event: "+err.Error())
+			return
+		}
+	}
 
-	objectName := event.Data.Name
-	log.Printf("Received Eventarc trigger for GCS object: %s in bucket: %s", objectName, event.Data.Bucket)
+	dryRun := dryRunDefault || r.URL.Query().Get("dry") == "1"
 
-	err = processFile(ctx, objectName)
+	// Changes are collected first so that a batch of events rewrites each
+	// feed once rather than once per event.
+	var changes []*feedChange
+	var objects []string
+	for _, event := range events {
+		objectName := event.Data.Name
+		objects = append(objects, objectName)
+		logger.Info("Received Eventarc trigger", "object", objectName, "bucket", event.Data.Bucket, "type", event.Type)
+
+		var change *feedChange
+		switch event.Type {
+		case eventTypeDeleted, eventTypeArchived:
+			change, err = removalChange(ctx, objectName)
+		case eventTypeMetadataUpdated:
+			change, err = metadataChange(ctx, objectName)
+		default:
+			change, err = fileChange(ctx, objectName)
+		}
+		if err != nil {
+			break
+		}
+		if change != nil {
+			changes = append(changes, change)
+		}
+	}
+
+	var preview string
+	if err == nil {
+		preview, err = applyChanges(ctx, changes, dryRun)
+	}
 	if err != nil {
-		log.Printf("Error processing files: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"error":"Processing failed"}`)
+		logger.Error("Error processing files", "objects", objects, "error", err,
+			"latency", time.Since(start).String())
+		writeError(w, http.StatusInternalServerError, "processing_failed", "Processing failed")
 		return
 	}
 
+	logger.Info("Processing completed", "objects", objects, "dry_run", dryRun, "latency", time.Since(start).String())
+	if dryRun && preview != "" {
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		io.WriteString(w, preview)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
+	if dryRun {
+		fmt.Fprintf(w, `{"status":"dry run, feed unchanged"}`)
+		return
+	}
 	fmt.Fprintf(w, `{"status":"processing completed"}`)
 }
 
-func main() {
-	defer gcsClient.Close()
+func rebuildHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
 
-	// Use a new ServeMux for custom server configuration
+	ctx, cancel := processContext()
+	defer cancel()
+
+	count, err := rebuildFeed(ctx)
+	if err != nil {
+		logger.Error("Error rebuilding feed", "error", err)
+		writeError(w, http.StatusInternalServerError, "rebuild_failed", "Rebuild failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"status":"rebuild completed","items":%d}`, count)
+}
+
+// reindexHandler reconciles every show's feed with the files bucket and
+// reports the episodes added and the items removed.
+func reindexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	ctx, cancel := processContext()
+	defer cancel()
+
+	result := struct {
+		Added   []string `json:"added"`
+		Removed []string `json:"removed"`
+	}{Added: []string{}, Removed: []string{}}
+
+	for _, show := range shows {
+		added, removed, err := reindexShow(ctx, show)
+		if err != nil {
+			logger.Error("Error reindexing feed", "feed", show.IndexObject, "error", err)
+			writeError(w, http.StatusInternalServerError, "reindex_failed", "Reindex failed")
+			return
+		}
+		logger.Info("Reindexed feed", "feed", show.IndexObject, "added", len(added), "removed", len(removed))
+		result.Added = append(result.Added, added...)
+		result.Removed = append(result.Removed, removed...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// newRouter returns the handler for every route the service serves.
+func newRouter() *http.ServeMux {
 	router := http.NewServeMux()
 
 	router.HandleFunc("/health", healthHandler)
-	router.HandleFunc("/feed", feedHandler)
-	router.HandleFunc("/files/{file}", fileHandler)
-	router.HandleFunc("/index.xml", feedHandler)
-	router.HandleFunc("/process", processHandler)
-	router.HandleFunc("/", feedHandler)
+	router.HandleFunc("/ready", readyHandler)
+	router.HandleFunc("/stats", statsHandler)
+	router.Handle("/metrics", promhttp.Handler())
+	router.HandleFunc("/feed", withCORS(withGzip(feedHandler)))
+	router.HandleFunc("/feed/{show}", withCORS(withGzip(feedHandler)))
+	router.HandleFunc("/feed.json", withCORS(withGzip(jsonFeedHandler)))
+	router.HandleFunc("/feeds.opml", withCORS(opmlHandler))
+	router.HandleFunc("/files/{file}", withCORS(withWriteDeadline(processTimeout, fileHandler)))
+	router.HandleFunc("/item/{file}", withCORS(itemHandler))
+	router.HandleFunc("DELETE /files/{file}", requireAuth(withWriteDeadline(processTimeout, deleteFileHandler)))
+	router.HandleFunc("/index.xml", withCORS(withGzip(feedHandler)))
+	router.HandleFunc("/process", requireAuth(withWriteDeadline(processTimeout, processHandler)))
+	router.HandleFunc("/rebuild", requireAuth(withWriteDeadline(processTimeout, rebuildHandler)))
+	router.HandleFunc("/admin/reindex", requireAuth(withWriteDeadline(processTimeout, reindexHandler)))
+	router.HandleFunc("/{$}", withGzip(indexPageHandler))
+	router.HandleFunc("/", notFoundHandler)
+	return router
+}
 
+// newServer returns the HTTP server for the routes in newRouter, listening
+// on PORT.
+func newServer() *http.Server {
 	// Configure HTTP/2 over cleartext (h2c) for Cloud Run.
 	// Cloud Run can proxy requests and forward them as HTTP/2 to the container
 	// if the container is configured to handle it (e.g., using h2c).
-	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: h2c.NewHandler(router, &http2.Server{}), // Wrap the router with h2c.NewHandler
+	// WriteTimeout suits the feed and health routes; the long-running
+	// routes in newRouter extend their own deadline with withWriteDeadline.
+	return &http.Server{
+		Addr:              ":" + port,
+		Handler:           h2c.NewHandler(withAccessLog(newRouter()), &http2.Server{}), // Wrap the router with h2c.NewHandler
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
 	}
+}
 
-	log.Printf("Starting server on port %s (HTTP/2 enabled via h2c)", port)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server error: %v", err)
+func main() {
+	checkConfig()
+	connectStorage()
+	defer gcsClient.Close()
+
+	server := newServer()
+	go func() {
+		logger.Info("Starting server (HTTP/2 enabled via h2c)", "port", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server error", "error", err)
+		}
+	}()
+
+	// Cloud Run sends SIGTERM before stopping the container; stop accepting
+	// new requests and let in-flight ones finish so index.xml isn't left
+	// half-written.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+
+	logger.Info("Shutting down, waiting for in-flight requests", "timeout", shutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Error during shutdown", "error", err)
 	}
 }
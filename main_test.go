@@ -0,0 +1,968 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestMain(m *testing.M) {
+	logger = newLogger(io.Discard)
+	os.Exit(m.Run())
+}
+
+// useFakeStores replaces the index and files buckets with empty fakes for
+// the duration of the test.
+func useFakeStores(t *testing.T) (index, files *fakeStore) {
+	t.Helper()
+	index, files = newFakeStore(), newFakeStore()
+	oldIndex, oldFiles := indexStore, filesStore
+	indexStore, filesStore = index, files
+	t.Cleanup(func() {
+		indexStore, filesStore = oldIndex, oldFiles
+		for _, show := range shows {
+			show.cached = nil
+		}
+	})
+	return index, files
+}
+
+// setForTest sets *p to v for the duration of the test.
+func setForTest[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// readTestFeed parses the default show's index.xml from index.
+func readTestFeed(t *testing.T, index *fakeStore) *RSS {
+	t.Helper()
+	content := index.content(shows[0].IndexObject)
+	if content == "" {
+		t.Fatalf("%s was not written", shows[0].IndexObject)
+	}
+	feed, err := parseFeed(content)
+	if err != nil {
+		t.Fatalf("parseFeed: %v", err)
+	}
+	return feed
+}
+
+// putTestFeed stores the default show's index.xml in index, holding items,
+// and returns its content.
+func putTestFeed(t *testing.T, index *fakeStore, items ...Item) []byte {
+	t.Helper()
+	doc := renderTestFeed(t, items...)
+	index.put(shows[0].IndexObject, doc, &storage.ObjectAttrs{ContentType: feedContentType})
+	return doc
+}
+
+// serve sends a request with the given headers to h and returns the
+// response.
+func serve(h http.HandlerFunc, method, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestProcessFile(t *testing.T) {
+	index, files := useFakeStores(t)
+	files.put("pilot.mp3", []byte("not really audio"), &storage.ObjectAttrs{ContentType: "audio/mpeg"})
+	files.put("notes.pdf", []byte("%PDF"), nil)
+
+	ctx := context.Background()
+	for _, name := range []string{"pilot.mp3", "notes.pdf", "pilot.mp3"} {
+		if _, err := processFile(ctx, name, false); err != nil {
+			t.Fatalf("processFile(%q): %v", name, err)
+		}
+	}
+
+	feed := readTestFeed(t, index)
+	if len(feed.Channel.Items) != 1 {
+		t.Fatalf("feed has %d items, want 1", len(feed.Channel.Items))
+	}
+	item := feed.Channel.Items[0]
+	if item.GUID.Value != "pilot.mp3" {
+		t.Errorf("guid = %q, want %q", item.GUID.Value, "pilot.mp3")
+	}
+	if want := titleFromName("pilot.mp3"); item.Title != want {
+		t.Errorf("title = %q, want %q", item.Title, want)
+	}
+	if want := fileURL("pilot.mp3"); item.Enclosure.URL != want {
+		t.Errorf("enclosure URL = %q, want %q", item.Enclosure.URL, want)
+	}
+	if item.Enclosure.Length != 16 || item.Enclosure.Type != "audio/mpeg" {
+		t.Errorf("enclosure = %d %q, want 16 audio/mpeg", item.Enclosure.Length, item.Enclosure.Type)
+	}
+
+	if names := index.names(); !slices.Equal(names, []string{shows[0].IndexObject}) {
+		t.Errorf("index bucket holds %q, want only %s", names, shows[0].IndexObject)
+	}
+}
+
+func TestProcessFileDryRun(t *testing.T) {
+	index, files := useFakeStores(t)
+	files.put("pilot.mp3", []byte("not really audio"), nil)
+
+	preview, err := processFile(context.Background(), "pilot.mp3", true)
+	if err != nil {
+		t.Fatalf("processFile: %v", err)
+	}
+	if !strings.Contains(preview, "<guid isPermaLink=\"false\">pilot.mp3</guid>") {
+		t.Errorf("preview has no item for pilot.mp3:\n%s", preview)
+	}
+	if names := index.names(); len(names) != 0 {
+		t.Errorf("dry run wrote %q", names)
+	}
+}
+
+// finalizedEvent returns a storage finalized CloudEvent for object name in
+// bucket.
+func finalizedEvent(bucket, name string) string {
+	return fmt.Sprintf(`{"specversion":"1.0","id":%[2]q,"type":"google.cloud.storage.object.v1.finalized",`+
+		`"source":"//storage.googleapis.com/projects/_/buckets/%[1]s","data":{"bucket":%[1]q,"name":%[2]q}}`, bucket, name)
+}
+
+// postEvent sends a storage finalized CloudEvent for object name in bucket
+// to processHandler.
+func postEvent(bucket, name string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	processHandler(w, httptest.NewRequest(http.MethodPost, "/process", strings.NewReader(finalizedEvent(bucket, name))))
+	return w
+}
+
+func TestProcessHandlerBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		bucket  string
+		code    int
+		written bool
+	}{
+		{"files bucket", filesBucketName, http.StatusOK, true},
+		{"foreign bucket", "someone-elses-bucket", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, files := useFakeStores(t)
+			files.put("pilot.mp3", []byte("not really audio"), nil)
+
+			w := postEvent(tt.bucket, "pilot.mp3")
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if written := index.content(shows[0].IndexObject) != ""; written != tt.written {
+				t.Errorf("index.xml written = %v, want %v", written, tt.written)
+			}
+		})
+	}
+}
+
+// pubSubPush returns a GCS notification for object name in bucket as a
+// Pub/Sub push subscription delivers it, with the object resource
+// base64-encoded in message.data.
+func pubSubPush(eventType, bucket, name string) string {
+	object := fmt.Sprintf(`{"kind":"storage#object","id":"%[1]s/%[2]s/1714564800000000","name":%[2]q,`+
+		`"bucket":%[1]q,"generation":"1714564800000000","contentType":"audio/mpeg","size":"16"}`, bucket, name)
+	return fmt.Sprintf(`{"message":{"attributes":{"bucketId":%[2]q,"eventTime":"2024-05-01T12:00:00.000000Z",`+
+		`"eventType":%[1]q,"notificationConfig":"projects/_/buckets/%[2]s/notificationConfigs/1",`+
+		`"objectGeneration":"1714564800000000","objectId":%[3]q,"payloadFormat":"JSON_API_V1"},`+
+		`"data":%[4]q,"messageId":"10533845210939613","message_id":"10533845210939613",`+
+		`"publishTime":"2024-05-01T12:00:00.123Z","publish_time":"2024-05-01T12:00:00.123Z"},`+
+		`"subscription":"projects/my-project/subscriptions/podcast-files"}`,
+		eventType, bucket, name, base64.StdEncoding.EncodeToString([]byte(object)))
+}
+
+func TestParseEventPubSub(t *testing.T) {
+	tests := []struct {
+		eventType string
+		want      string
+	}{
+		{"OBJECT_FINALIZE", "google.cloud.storage.object.v1.finalized"},
+		{"OBJECT_DELETE", eventTypeDeleted},
+		{"OBJECT_ARCHIVE", eventTypeArchived},
+		{"OBJECT_METADATA_UPDATE", eventTypeMetadataUpdated},
+	}
+	for _, tt := range tests {
+		event, err := parseEvent([]byte(pubSubPush(tt.eventType, "podcast-files", "show/ep 1.mp3")))
+		if err != nil {
+			t.Fatalf("parseEvent(%s): %v", tt.eventType, err)
+		}
+		if event.Data.Name != "show/ep 1.mp3" || event.Data.Bucket != "podcast-files" {
+			t.Errorf("%s: data = %+v, want show/ep 1.mp3 in podcast-files", tt.eventType, event.Data)
+		}
+		if event.Type != tt.want {
+			t.Errorf("%s: type = %q, want %q", tt.eventType, event.Type, tt.want)
+		}
+		if event.ID != "10533845210939613" || event.SpecVersion != "1.0" {
+			t.Errorf("%s: id %q, specversion %q", tt.eventType, event.ID, event.SpecVersion)
+		}
+	}
+}
+
+func TestProcessHandlerArchived(t *testing.T) {
+	tests := []struct {
+		name        string
+		overwritten bool
+		items       int
+	}{
+		{"deleted", false, 0},
+		{"overwritten", true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, files := useFakeStores(t)
+			files.put("ep1.mp3", []byte("not really audio"), nil)
+			if _, err := processFile(context.Background(), "ep1.mp3", false); err != nil {
+				t.Fatalf("processFile: %v", err)
+			}
+			if !tt.overwritten {
+				files.Delete(context.Background(), "ep1.mp3")
+			}
+
+			body := pubSubPush("OBJECT_ARCHIVE", filesBucketName, "ep1.mp3")
+			w := httptest.NewRecorder()
+			processHandler(w, httptest.NewRequest(http.MethodPost, "/process", strings.NewReader(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			if n := len(readTestFeed(t, index).Channel.Items); n != tt.items {
+				t.Errorf("feed has %d items, want %d", n, tt.items)
+			}
+		})
+	}
+}
+
+func TestWriteFeedArchives(t *testing.T) {
+	index, files := useFakeStores(t)
+	oldMax := feedMaxItems
+	feedMaxItems = 2
+	t.Cleanup(func() { feedMaxItems = oldMax })
+
+	ctx := context.Background()
+	for _, name := range []string{"ep1.mp3", "ep2.mp3", "ep3.mp3", "ep4.mp3", "ep5.mp3"} {
+		files.put(name, []byte("not really audio"), nil)
+		if _, err := processFile(ctx, name, false); err != nil {
+			t.Fatalf("processFile(%q): %v", name, err)
+		}
+	}
+
+	// Only the archive pages of the last write are left.
+	names := index.names()
+	if len(names) != 3 || !slices.Contains(names, shows[0].IndexObject) {
+		t.Fatalf("index bucket holds %q, want index.xml and two archive pages", names)
+	}
+
+	first := readTestFeed(t, index)
+	if len(first.Channel.Items) != 2 {
+		t.Errorf("index.xml has %d items, want 2", len(first.Channel.Items))
+	}
+	version, ok := nextArchiveVersion(&first.Channel)
+	if !ok {
+		t.Fatal("index.xml has no rel=\"next\" link")
+	}
+	for n := 2; n <= 3; n++ {
+		if name := shows[0].archiveObject(n, version); !slices.Contains(names, name) {
+			t.Errorf("archive page %s was not written", name)
+		}
+	}
+
+	feed, gen, err := readFeed(ctx, shows[0])
+	if err != nil {
+		t.Fatalf("readFeed: %v", err)
+	}
+	if len(feed.Channel.Items) != 5 {
+		t.Errorf("readFeed returned %d items, want 5", len(feed.Channel.Items))
+	}
+
+	// A write that loses the race for index.xml leaves the published pages
+	// as they were.
+	if err := writeFeed(ctx, shows[0], feed, gen+100); !isPreconditionFailed(err) {
+		t.Fatalf("writeFeed with stale generation = %v, want precondition failure", err)
+	}
+	if after := index.names(); !slices.Equal(after, names) {
+		t.Errorf("after failed write index bucket holds %q, want %q", after, names)
+	}
+}
+
+func TestMetadataChange(t *testing.T) {
+	index, files := useFakeStores(t)
+	ctx := context.Background()
+	files.put("ep1.mp3", []byte("not really audio"), nil)
+	if _, err := processFile(ctx, "ep1.mp3", false); err != nil {
+		t.Fatalf("processFile: %v", err)
+	}
+
+	update := func(name string, metadata map[string]string) {
+		t.Helper()
+		files.put(name, []byte("not really audio"), &storage.ObjectAttrs{Metadata: metadata})
+		change, err := metadataChange(ctx, name)
+		if err != nil {
+			t.Fatalf("metadataChange(%q): %v", name, err)
+		}
+		if change == nil {
+			return
+		}
+		if _, err := applyChanges(ctx, []*feedChange{change}, false); err != nil {
+			t.Fatalf("applyChanges: %v", err)
+		}
+	}
+
+	update("ep1.mp3", map[string]string{"title": "Pilot", "keywords": "news, tech"})
+	feed := readTestFeed(t, index)
+	if len(feed.Channel.Items) != 1 {
+		t.Fatalf("feed has %d items, want 1", len(feed.Channel.Items))
+	}
+	if item := feed.Channel.Items[0]; item.Title != "Pilot" || item.ITunesKeywords != "news,tech" {
+		t.Errorf("item has title %q and keywords %q, want Pilot and news,tech", item.Title, item.ITunesKeywords)
+	}
+
+	// Metadata edits don't add episodes that aren't in the feed.
+	update("ep2.mp3", map[string]string{"title": "Second"})
+	if n := len(readTestFeed(t, index).Channel.Items); n != 1 {
+		t.Errorf("feed has %d items after editing an unlisted episode, want 1", n)
+	}
+
+	update("ep1.mp3", map[string]string{"skip-feed": "true"})
+	if n := len(readTestFeed(t, index).Channel.Items); n != 0 {
+		t.Errorf("feed has %d items after skip-feed, want 0", n)
+	}
+}
+
+func TestFeedHandlerETag(t *testing.T) {
+	index, _ := useFakeStores(t)
+	doc := putTestFeed(t, index, testItem(1))
+	etag := serve(feedHandler, http.MethodGet, "/feed", nil).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("feed has no ETag")
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		code        int
+	}{
+		{"matching", etag, http.StatusNotModified},
+		{"weak", "W/" + etag, http.StatusNotModified},
+		{"gzip form", gzipETag(etag), http.StatusNotModified},
+		{"in a list", `"0", ` + etag, http.StatusNotModified},
+		{"wildcard", "*", http.StatusNotModified},
+		{"not matching", `"0"`, http.StatusOK},
+		{"no header", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.ifNoneMatch != "" {
+				header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := serve(feedHandler, http.MethodGet, "/feed", header)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if got := w.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag = %q, want %q", got, etag)
+			}
+			want := string(doc)
+			if tt.code == http.StatusNotModified {
+				want = ""
+			}
+			if w.Body.String() != want {
+				t.Errorf("body is %d bytes, want %d", w.Body.Len(), len(want))
+			}
+		})
+	}
+}
+
+func TestFeedHandlerLastModified(t *testing.T) {
+	index, _ := useFakeStores(t)
+	putTestFeed(t, index, testItem(1))
+	attrs, err := index.Attrs(context.Background(), shows[0].IndexObject)
+	if err != nil {
+		t.Fatalf("Attrs: %v", err)
+	}
+	updated := attrs.Updated.UTC()
+
+	tests := []struct {
+		name            string
+		ifModifiedSince string
+		ifNoneMatch     string
+		code            int
+	}{
+		{"same time", updated.Format(http.TimeFormat), "", http.StatusNotModified},
+		{"later", updated.Add(time.Hour).Format(http.TimeFormat), "", http.StatusNotModified},
+		{"earlier", updated.Add(-time.Hour).Format(http.TimeFormat), "", http.StatusOK},
+		{"invalid date", "yesterday", "", http.StatusOK},
+		{"If-None-Match takes precedence", updated.Format(http.TimeFormat), `"0"`, http.StatusOK},
+		{"no header", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.ifModifiedSince != "" {
+				header.Set("If-Modified-Since", tt.ifModifiedSince)
+			}
+			if tt.ifNoneMatch != "" {
+				header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := serve(feedHandler, http.MethodGet, "/feed", header)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if lm, want := w.Header().Get("Last-Modified"), updated.Format(http.TimeFormat); lm != want {
+				t.Errorf("Last-Modified = %q, want %q", lm, want)
+			}
+			if empty := w.Body.Len() == 0; empty != (tt.code == http.StatusNotModified) {
+				t.Errorf("status %d with a %d-byte body", w.Code, w.Body.Len())
+			}
+		})
+	}
+}
+
+func TestLoadFeedNotFound(t *testing.T) {
+	index, files := useFakeStores(t)
+	for _, name := range []string{"ep1.mp3", "ep2.mp3", "ep3.mp3"} {
+		files.put(name, []byte("not really audio"), nil)
+	}
+
+	// With no index.xml, the feed is rebuilt from the files bucket rather
+	// than started empty.
+	if _, err := processFile(context.Background(), "ep3.mp3", false); err != nil {
+		t.Fatalf("processFile: %v", err)
+	}
+	if n := len(readTestFeed(t, index).Channel.Items); n != 3 {
+		t.Errorf("feed has %d items, want 3", n)
+	}
+}
+
+func TestLoadFeedUnavailable(t *testing.T) {
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "backendError"}
+	tests := []struct {
+		name   string
+		failed []string // operations on index.xml that fail
+		update func(ctx context.Context) error
+	}{
+		{"adding an episode", []string{"Read", "Attrs", "NewRangeReader"}, func(ctx context.Context) error {
+			_, err := processFile(ctx, "ep3.mp3", false)
+			return err
+		}},
+		{"removing an episode", []string{"Read"}, func(ctx context.Context) error {
+			_, err := removeFile(ctx, "ep1.mp3", false)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, files := useFakeStores(t)
+			doc := putTestFeed(t, index, testItem(1), testItem(2))
+			files.put("ep2.mp3", []byte("not really audio"), nil)
+			files.put("ep3.mp3", []byte("not really audio"), nil)
+			index.fail = func(op, name string) error {
+				if name == shows[0].IndexObject && slices.Contains(tt.failed, op) {
+					return unavailable
+				}
+				return nil
+			}
+
+			if err := tt.update(context.Background()); !errors.Is(err, unavailable) {
+				t.Errorf("update = %v, want the 503", err)
+			}
+			if len(index.written) != 0 {
+				t.Errorf("wrote %q", index.written)
+			}
+			if got := index.content(shows[0].IndexObject); got != string(doc) {
+				t.Errorf("index.xml changed to\n%s", got)
+			}
+		})
+	}
+}
+
+func TestFeedHandlerContentLength(t *testing.T) {
+	index, _ := useFakeStores(t)
+	putTestFeed(t, index, testItem(1), testItem(2), testItem(3))
+
+	w := serve(feedHandler, http.MethodGet, "/feed", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if cl, want := w.Header().Get("Content-Length"), strconv.Itoa(w.Body.Len()); cl != want {
+		t.Errorf("Content-Length = %q, want %s", cl, want)
+	}
+}
+
+func TestValidObjectName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"ep1.mp3", true},
+		{"show/ep1.mp3", true},
+		{"..ep1.mp3", true},
+		{"../index.xml", false},
+		{"show/../../index.xml", false},
+		{"show/..", false},
+		{"./ep1.mp3", false},
+		{"/etc/passwd", false},
+		{"show//ep1.mp3", false},
+		{`..\index.xml`, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validObjectName(tt.name); got != tt.want {
+			t.Errorf("validObjectName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFileHandlerPathTraversal(t *testing.T) {
+	_, files := useFakeStores(t)
+	files.put("ep1.mp3", []byte("not really audio"), nil)
+	router := newRouter()
+
+	tests := []struct {
+		name   string
+		target string
+		code   int
+	}{
+		{"normal name", "/files/ep1.mp3", http.StatusFound},
+		{"parent directory", "/files/..%2Findex.xml", http.StatusBadRequest},
+		{"absolute path", "/files/%2Fetc%2Fpasswd", http.StatusBadRequest},
+		{"backslash", "/files/..%5Cindex.xml", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if tt.code == http.StatusBadRequest && !strings.Contains(w.Body.String(), `"invalid_file_name"`) {
+				t.Errorf("body = %s, want the invalid_file_name code", w.Body)
+			}
+		})
+	}
+}
+
+func TestFileHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		signError error
+		code      int
+		errCode   string
+	}{
+		{"exists", "ep1.mp3", nil, http.StatusFound, ""},
+		{"not found", "missing.mp3", nil, http.StatusNotFound, "file_not_found"},
+		{"signing fails", "ep1.mp3", errors.New("iam: permission denied"), http.StatusInternalServerError, "signing_failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, files := useFakeStores(t)
+			files.put("ep1.mp3", []byte("not really audio"), nil)
+			files.fail = func(op, name string) error {
+				if op == "SignedURL" {
+					return tt.signError
+				}
+				return nil
+			}
+
+			w := httptest.NewRecorder()
+			newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+tt.file, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if tt.errCode == "" {
+				if loc := w.Header().Get("Location"); !strings.HasPrefix(loc, "https://storage.example.com/ep1.mp3") {
+					t.Errorf("Location = %q, want a signed URL for ep1.mp3", loc)
+				}
+				return
+			}
+			var body struct{ Code string }
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Code != tt.errCode {
+				t.Errorf("error code = %q, %v, want %q", body.Code, err, tt.errCode)
+			}
+		})
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	index, _ := useFakeStores(t)
+	putTestFeed(t, index, testItem(1))
+	router := newRouter()
+
+	tests := []struct {
+		target      string
+		code        int
+		contentType string
+	}{
+		{"/favicon.ico", http.StatusNotFound, "application/json"},
+		{"/robots.txt", http.StatusNotFound, "application/json"},
+		{"/feed/extra/path", http.StatusNotFound, "application/json"},
+		{"/", http.StatusOK, "text/html; charset=utf-8"},
+		{"/feed", http.StatusOK, feedContentType},
+		{"/index.xml", http.StatusOK, feedContentType},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != tt.code || w.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("GET %s = %d %q, want %d %q", tt.target, w.Code, w.Header().Get("Content-Type"), tt.code, tt.contentType)
+		}
+	}
+}
+
+func TestProcessHandlerBatch(t *testing.T) {
+	index, files := useFakeStores(t)
+	putTestFeed(t, index)
+	var events []string
+	for _, name := range []string{"ep1.mp3", "ep2.mp3", "ep3.mp3"} {
+		files.put(name, []byte("not really audio"), nil)
+		events = append(events, finalizedEvent(filesBucketName, name))
+	}
+	body := "[" + strings.Join(events, ",") + "]"
+
+	w := httptest.NewRecorder()
+	processHandler(w, httptest.NewRequest(http.MethodPost, "/process", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if n := index.writes(shows[0].IndexObject); n != 1 {
+		t.Errorf("index.xml written %d times, want 1", n)
+	}
+	if n := len(readTestFeed(t, index).Channel.Items); n != 3 {
+		t.Errorf("feed has %d items, want 3", n)
+	}
+}
+
+func TestWriteAbandonedNearDeadline(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	nearDeadline, cancel := context.WithTimeout(context.Background(), minWriteTime/2)
+	defer cancel()
+
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		items []Item // in the existing index.xml, if any
+	}{
+		{"cancelled, streamed", cancelled, []Item{testItem(1)}},
+		{"cancelled, full update", cancelled, nil},
+		{"near deadline, streamed", nearDeadline, []Item{testItem(1)}},
+		{"near deadline, full update", nearDeadline, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, files := useFakeStores(t)
+			var doc []byte
+			if tt.items != nil {
+				doc = putTestFeed(t, index, tt.items...)
+			}
+			files.put("ep2.mp3", []byte("not really audio"), nil)
+			index.fail = func(op, name string) error {
+				if op == "Write" || op == "NewWriter" || op == "Copy" {
+					t.Errorf("%s(%q) called", op, name)
+				}
+				return nil
+			}
+
+			if _, err := processFile(tt.ctx, "ep2.mp3", false); err == nil || !strings.Contains(err.Error(), "not writing") {
+				t.Errorf("processFile = %v, want the write abandoned", err)
+			}
+			if got := index.content(shows[0].IndexObject); got != string(doc) {
+				t.Errorf("index.xml changed to\n%s", got)
+			}
+		})
+	}
+}
+
+func TestFailedWriteLeavesIndex(t *testing.T) {
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "backendError"}
+	tests := []struct {
+		name  string
+		fails func(op, name string) bool
+	}{
+		{"temporary object", func(op, name string) bool {
+			return (op == "Write" || op == "NewWriter") && strings.Contains(name, ".tmp-")
+		}},
+		{"copy", func(op, name string) bool {
+			return op == "Copy" && name == shows[0].IndexObject
+		}},
+	}
+	for _, tt := range tests {
+		for _, streamed := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/streamed=%v", tt.name, streamed), func(t *testing.T) {
+				index, files := useFakeStores(t)
+				var doc []byte
+				if streamed {
+					doc = putTestFeed(t, index, testItem(1))
+				}
+				files.put("ep2.mp3", []byte("not really audio"), nil)
+				index.fail = func(op, name string) error {
+					if tt.fails(op, name) {
+						return unavailable
+					}
+					return nil
+				}
+
+				if _, err := processFile(context.Background(), "ep2.mp3", false); !errors.Is(err, unavailable) {
+					t.Errorf("processFile = %v, want the 503", err)
+				}
+				if got := index.content(shows[0].IndexObject); got != string(doc) {
+					t.Errorf("index.xml changed to\n%s", got)
+				}
+				var want []string
+				if streamed {
+					want = []string{shows[0].IndexObject}
+				}
+				if names := index.names(); !slices.Equal(names, want) {
+					t.Errorf("index bucket holds %q, want %q", names, want)
+				}
+			})
+		}
+	}
+}
+
+func TestReindexHandler(t *testing.T) {
+	index, files := useFakeStores(t)
+	putTestFeed(t, index, testItem(1), testItem(2))
+	files.put("ep1.mp3", []byte("not really audio"), nil)
+	files.put("ep3.mp3", []byte("not really audio"), nil)
+	files.put("notes.pdf", []byte("%PDF"), nil)
+
+	if w := serve(reindexHandler, http.MethodGet, "/admin/reindex", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want 405", w.Code)
+	}
+
+	w := serve(reindexHandler, http.MethodPost, "/admin/reindex", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var result struct {
+		Added   []string `json:"added"`
+		Removed []string `json:"removed"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body, err)
+	}
+	if !slices.Equal(result.Added, []string{"ep3.mp3"}) || !slices.Equal(result.Removed, []string{"ep2.mp3"}) {
+		t.Errorf("added %q and removed %q, want [ep3.mp3] and [ep2.mp3]", result.Added, result.Removed)
+	}
+
+	// The item whose episode is still there is kept as it was.
+	var guids []string
+	for _, item := range readTestFeed(t, index).Channel.Items {
+		guids = append(guids, item.GUID.Value)
+		if item.GUID.Value == "ep1.mp3" && item.Title != testItem(1).Title {
+			t.Errorf("ep1.mp3 has title %q, want %q", item.Title, testItem(1).Title)
+		}
+	}
+	slices.Sort(guids)
+	if !slices.Equal(guids, []string{"ep1.mp3", "ep3.mp3"}) {
+		t.Errorf("feed has items %q, want ep1.mp3 and ep3.mp3", guids)
+	}
+
+	// A second reindex has nothing to do.
+	w = serve(reindexHandler, http.MethodPost, "/admin/reindex", nil)
+	if body := strings.TrimSpace(w.Body.String()); body != `{"added":[],"removed":[]}` {
+		t.Errorf("second reindex returned %s", body)
+	}
+}
+
+func TestItemHandler(t *testing.T) {
+	_, files := useFakeStores(t)
+	files.put("ep1.mp3", []byte("not really audio"), &storage.ObjectAttrs{
+		ContentType: "audio/mpeg",
+		Metadata:    map[string]string{"title": "Pilot"},
+	})
+	files.put("notes.pdf", []byte("%PDF"), nil)
+	router := newRouter()
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := get("/item/ep1.mp3")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/xml; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want application/xml; charset=utf-8", ct)
+	}
+	var item Item
+	if err := xml.Unmarshal(w.Body.Bytes(), &item); err != nil {
+		t.Fatalf("decoding item: %v\n%s", err, w.Body)
+	}
+	if item.GUID.Value != "ep1.mp3" || item.Title != "Pilot" {
+		t.Errorf("item has guid %q and title %q, want ep1.mp3 and Pilot", item.GUID.Value, item.Title)
+	}
+	want := Enclosure{URL: fileURL("ep1.mp3"), Length: 16, Type: "audio/mpeg"}
+	if item.Enclosure != want {
+		t.Errorf("enclosure = %+v, want %+v", item.Enclosure, want)
+	}
+
+	for _, target := range []string{"/item/notes.pdf", "/item/missing.mp3"} {
+		if w := get(target); w.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want 404", target, w.Code)
+		}
+	}
+
+	files.fail = func(op, name string) error {
+		return &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "backendError"}
+	}
+	if w := get("/item/ep1.mp3"); w.Code != http.StatusInternalServerError {
+		t.Errorf("with the bucket unavailable: status = %d, want 500", w.Code)
+	}
+}
+
+func TestGetIndexXMLCache(t *testing.T) {
+	for _, revalidate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("revalidate=%v", revalidate), func(t *testing.T) {
+			index, _ := useFakeStores(t)
+			fake := useFakeClock(t, testEpoch)
+			setForTest(t, &cacheRevalidate, revalidate)
+			ctx := context.Background()
+
+			putTestFeed(t, index, testItem(1))
+			first, err := getIndexXML(ctx, shows[0])
+			if err != nil {
+				t.Fatalf("getIndexXML: %v", err)
+			}
+			updated := string(putTestFeed(t, index, testItem(1), testItem(2)))
+
+			// Within the TTL the cached copy is served, unless the
+			// generation is checked.
+			<-fake.After(cacheTTL - time.Second)
+			got, err := getIndexXML(ctx, shows[0])
+			if err != nil {
+				t.Fatalf("getIndexXML: %v", err)
+			}
+			if revalidate && got.Content != updated {
+				t.Errorf("within the TTL got the cached copy, want the update")
+			}
+			if !revalidate && got != first {
+				t.Errorf("within the TTL got a fresh read, want the cached copy")
+			}
+
+			<-fake.After(time.Second)
+			got, err = getIndexXML(ctx, shows[0])
+			if err != nil {
+				t.Fatalf("getIndexXML: %v", err)
+			}
+			if got.Content != updated {
+				t.Errorf("after the TTL got the cached copy, want the update")
+			}
+		})
+	}
+}
+
+func TestServerWithoutEnv(t *testing.T) {
+	// The package is loaded with no environment set, as in every test; the
+	// server must still start and serve from the fake stores.
+	index, files := useFakeStores(t)
+	putTestFeed(t, index, testItem(1))
+	files.put("ep2.mp3", []byte("not really audio"), nil)
+
+	srv := httptest.NewServer(newServer().Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodGet, "/health", "", http.StatusOK},
+		{http.MethodGet, "/ready", "", http.StatusOK},
+		{http.MethodGet, "/feed", "", http.StatusOK},
+		{http.MethodPost, "/process", finalizedEvent(filesBucketName, "ep2.mp3"), http.StatusOK},
+		{http.MethodGet, "/favicon.ico", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s %s: status = %d, want %d: %s", tt.method, tt.path, resp.StatusCode, tt.code, body)
+		}
+	}
+
+	if n := len(readTestFeed(t, index).Channel.Items); n != 2 {
+		t.Errorf("feed has %d items after /process, want 2", n)
+	}
+}
+
+func TestKeywordsFrom(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     string
+	}{
+		{"no metadata", nil, ""},
+		{"no keywords key", map[string]string{"title": "Pilot"}, ""},
+		{"empty", map[string]string{"keywords": ""}, ""},
+		{"only separators", map[string]string{"keywords": " , ,"}, ""},
+		{"single", map[string]string{"keywords": "news"}, "news"},
+		{"trimmed", map[string]string{"keywords": " news ,tech,  science "}, "news,tech,science"},
+		{"empty entries", map[string]string{"keywords": "news,,tech,"}, "news,tech"},
+	}
+	for _, tt := range tests {
+		if got := keywordsFrom(&storage.ObjectAttrs{Metadata: tt.metadata}); got != tt.want {
+			t.Errorf("%s: keywordsFrom = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProcessFileKeywords(t *testing.T) {
+	index, files := useFakeStores(t)
+	files.put("ep1.mp3", []byte("not really audio"), &storage.ObjectAttrs{
+		Metadata: map[string]string{"keywords": "Q&A, tech"},
+	})
+	files.put("ep2.mp3", []byte("not really audio"), nil)
+	for _, name := range []string{"ep1.mp3", "ep2.mp3"} {
+		if _, err := processFile(context.Background(), name, false); err != nil {
+			t.Fatalf("processFile(%q): %v", name, err)
+		}
+	}
+
+	content := index.content(shows[0].IndexObject)
+	if n := strings.Count(content, "<itunes:keywords>"); n != 1 {
+		t.Errorf("feed has %d itunes:keywords elements, want 1:\n%s", n, content)
+	}
+	if want := "<itunes:keywords>Q&amp;A,tech</itunes:keywords>"; !strings.Contains(content, want) {
+		t.Errorf("feed has no %s:\n%s", want, content)
+	}
+	for _, item := range readTestFeed(t, index).Channel.Items {
+		want := map[string]string{"ep1.mp3": "Q&A,tech", "ep2.mp3": ""}[item.GUID.Value]
+		if item.ITunesKeywords != want {
+			t.Errorf("%s has keywords %q, want %q", item.GUID.Value, item.ITunesKeywords, want)
+		}
+	}
+}
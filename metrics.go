@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics exposed at /metrics.
+var (
+	filesProcessed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "podcast_files_processed_total",
+		Help: "Audio files added to or updated in the feed.",
+	})
+	filesSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "podcast_files_skipped_total",
+		Help: "Objects ignored by the processor.",
+	})
+	feedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "podcast_feed_requests_total",
+		Help: "Requests for the podcast feed.",
+	})
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "podcast_feed_cache_hits_total",
+		Help: "Feed reads served from the in-process cache.",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "podcast_feed_cache_misses_total",
+		Help: "Feed reads that had to fetch index.xml from GCS.",
+	})
+	gcsReadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "podcast_gcs_read_duration_seconds",
+		Help:    "Time taken to read an object from GCS, including retries.",
+		Buckets: prometheus.DefBuckets,
+	})
+	gcsWriteDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "podcast_gcs_write_duration_seconds",
+		Help:    "Time taken to write an object to GCS, including retries.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// observeSince records the time elapsed since start in h.
+func observeSince(h prometheus.Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
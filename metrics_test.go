@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrapeCounter fetches /metrics and returns the value of the counter
+// called name.
+func scrapeCounter(t *testing.T, name string) float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics status = %d", w.Code)
+	}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), name+" ")
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("%s has value %q: %v", name, value, err)
+		}
+		return v
+	}
+	t.Fatalf("/metrics has no %s", name)
+	return 0
+}
+
+func TestMetricsProcessFile(t *testing.T) {
+	_, files := useFakeStores(t)
+	files.put("pilot.mp3", []byte("not really audio"), nil)
+	files.put("notes.pdf", []byte("%PDF"), nil)
+
+	processed := scrapeCounter(t, "podcast_files_processed_total")
+	skipped := scrapeCounter(t, "podcast_files_skipped_total")
+
+	ctx := context.Background()
+	for _, name := range []string{"pilot.mp3", "notes.pdf"} {
+		if _, err := processFile(ctx, name, false); err != nil {
+			t.Fatalf("processFile(%q): %v", name, err)
+		}
+	}
+
+	if got := scrapeCounter(t, "podcast_files_processed_total"); got != processed+1 {
+		t.Errorf("podcast_files_processed_total = %v, want %v", got, processed+1)
+	}
+	if got := scrapeCounter(t, "podcast_files_skipped_total"); got != skipped+1 {
+		t.Errorf("podcast_files_skipped_total = %v, want %v", got, skipped+1)
+	}
+}
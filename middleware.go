@@ -0,0 +1,258 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+// requireAuth rejects requests that don't carry a valid Google-signed OIDC
+// bearer token for processAudience, such as the one Eventarc attaches to its
+// push requests. When PROCESS_API_KEY is set, an X-API-Key header with that
+// key is accepted instead. Authentication is skipped when neither is
+// configured, which checkConfig only allows with ALLOW_UNAUTH.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if processAudience == "" && processAPIKey == "" {
+			next(w, r)
+			return
+		}
+
+		if key := r.Header.Get("X-API-Key"); key != "" && processAPIKey != "" {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(processAPIKey)) != 1 {
+				logger.Warn("Rejected request: invalid API key", "path", r.URL.Path)
+				writeUnauthorized(w)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		if processAudience == "" {
+			logger.Warn("Rejected request: missing API key", "path", r.URL.Path)
+			writeUnauthorized(w)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			logger.Warn("Rejected request: missing bearer token", "path", r.URL.Path)
+			writeUnauthorized(w)
+			return
+		}
+
+		if _, err := validateIDToken(r.Context(), token, processAudience); err != nil {
+			logger.Warn("Rejected request: invalid bearer token", "path", r.URL.Path, "error", err)
+			writeUnauthorized(w)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// validateIDToken checks the signature, expiry and audience of a
+// Google-signed ID token.
+var validateIDToken = idtoken.Validate
+
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+}
+
+// statusRecorder records the status code and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withAccessLog logs every request with its status, response size and
+// latency, in the httpRequest format Cloud Logging understands.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		latency := time.Since(start)
+		logger.Info("Request handled", slog.Group("httpRequest",
+			"requestMethod", r.Method,
+			"requestUrl", r.URL.RequestURI(),
+			"status", rec.status,
+			"responseSize", strconv.Itoa(rec.size),
+			"latency", fmt.Sprintf("%.6fs", latency.Seconds()),
+			"userAgent", r.UserAgent(),
+			"remoteIp", r.RemoteAddr,
+			"protocol", r.Proto,
+		))
+	})
+}
+
+// withWriteDeadline gives next d to write its response instead of the
+// server's WriteTimeout, for routes that legitimately run for a long time.
+func withWriteDeadline(d time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if d > 0 {
+			deadline = time.Now().Add(d)
+		}
+		if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+			logger.Warn("Could not extend write deadline", "path", r.URL.Path, "error", err)
+		}
+		next(w, r)
+	}
+}
+
+// withCORS lets browsers on corsOrigin read responses from next. OPTIONS
+// preflight requests are answered directly with 204 No Content.
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", corsOrigin)
+		h.Set("Access-Control-Expose-Headers", "ETag, Last-Modified, Content-Length, Content-Range, Accept-Ranges")
+		if corsOrigin != "*" {
+			h.Add("Vary", "Origin")
+		}
+
+		if r.Method == http.MethodOptions {
+			h.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Range, If-None-Match, If-Modified-Since")
+			h.Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// gzipResponseWriter compresses the response body written through it.
+// Responses that have no body, such as 304 Not Modified, are passed through
+// uncompressed. A strong ETag set by the handler gets gzipETagSuffix, as a
+// different content coding needs a different strong validator. For a HEAD
+// request the headers are those of the compressed GET response and the
+// body is discarded.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	head        bool
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if etag := w.Header().Get("ETag"); etag != "" {
+			w.Header().Set("ETag", gzipETag(etag))
+		}
+		if status != http.StatusNotModified && status != http.StatusNoContent {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Del("Content-Length")
+			if !w.head {
+				w.gz = gzip.NewWriter(w.ResponseWriter)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.head {
+		return len(b), nil
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+func (w *gzipResponseWriter) close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// gzipETagSuffix marks the ETag of a gzip-compressed response, e.g. "42-gzip"
+// for "42".
+const gzipETagSuffix = "-gzip"
+
+// gzipETag returns the ETag for the gzip-compressed form of a response with
+// ETag etag. Weak ETags are left as they are.
+func gzipETag(etag string) string {
+	if strings.HasPrefix(etag, "W/") || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + gzipETagSuffix + `"`
+}
+
+// withGzip compresses responses from next for clients that accept gzip.
+// HEAD requests are negotiated the same way, so they get the headers the
+// matching GET would.
+func withGzip(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, head: r.Method == http.MethodHead}
+		defer gw.close()
+
+		next(gw, r)
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		name, value, _ := strings.Cut(strings.TrimSpace(params), "=")
+		if strings.TrimSpace(name) == "q" {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
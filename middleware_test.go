@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/idtoken"
+)
+
+func TestWithGzip(t *testing.T) {
+	index, _ := useFakeStores(t)
+	doc := putTestFeed(t, index, testItem(1), testItem(2))
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{"gzip", "gzip, deflate, br", true},
+		{"gzip with q", "br;q=1.0, gzip;q=0.5", true},
+		{"gzip refused", "gzip;q=0", false},
+		{"other codings", "deflate, br", false},
+		{"no header", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.acceptEncoding != "" {
+				header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := serve(withGzip(feedHandler), http.MethodGet, "/feed", header)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			h := w.Header()
+			if vary := h.Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", vary)
+			}
+
+			body := w.Body.Bytes()
+			if tt.gzipped {
+				if enc := h.Get("Content-Encoding"); enc != "gzip" {
+					t.Errorf("Content-Encoding = %q, want gzip", enc)
+				}
+				if cl := h.Get("Content-Length"); cl != "" {
+					t.Errorf("Content-Length = %q, want none", cl)
+				}
+				if etag := h.Get("ETag"); !strings.HasSuffix(etag, gzipETagSuffix+`"`) {
+					t.Errorf("ETag = %q, want a %s suffix", etag, gzipETagSuffix)
+				}
+				gz, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("body isn't gzip: %v", err)
+				}
+				if body, err = io.ReadAll(gz); err != nil {
+					t.Fatalf("reading gzip body: %v", err)
+				}
+			} else {
+				if enc := h.Get("Content-Encoding"); enc != "" {
+					t.Errorf("Content-Encoding = %q, want none", enc)
+				}
+				if cl := h.Get("Content-Length"); cl != strconv.Itoa(len(doc)) {
+					t.Errorf("Content-Length = %q, want %d", cl, len(doc))
+				}
+				if etag := h.Get("ETag"); strings.Contains(etag, gzipETagSuffix) {
+					t.Errorf("ETag = %q, want no %s suffix", etag, gzipETagSuffix)
+				}
+			}
+			if !bytes.Equal(body, doc) {
+				t.Errorf("body is\n%s\nwant\n%s", body, doc)
+			}
+		})
+	}
+}
+
+func TestWithGzipHead(t *testing.T) {
+	index, _ := useFakeStores(t)
+	putTestFeed(t, index, testItem(1), testItem(2))
+
+	for _, acceptEncoding := range []string{"gzip", ""} {
+		t.Run(fmt.Sprintf("Accept-Encoding=%q", acceptEncoding), func(t *testing.T) {
+			header := http.Header{}
+			if acceptEncoding != "" {
+				header.Set("Accept-Encoding", acceptEncoding)
+			}
+			get := serve(withGzip(feedHandler), http.MethodGet, "/feed", header)
+			head := serve(withGzip(feedHandler), http.MethodHead, "/feed", header)
+
+			if head.Code != get.Code {
+				t.Errorf("HEAD status = %d, GET status = %d", head.Code, get.Code)
+			}
+			for _, name := range []string{"Content-Encoding", "Content-Length", "Content-Type", "ETag", "Last-Modified", "Vary"} {
+				if h, g := head.Header().Get(name), get.Header().Get(name); h != g {
+					t.Errorf("HEAD %s = %q, GET %s = %q", name, h, name, g)
+				}
+			}
+			if head.Body.Len() != 0 {
+				t.Errorf("HEAD response has a %d-byte body", head.Body.Len())
+			}
+		})
+	}
+}
+
+func TestRequireAuthToken(t *testing.T) {
+	const audience = "https://podcast-processor.example.com/process"
+	setForTest(t, &processAudience, audience)
+	setForTest(t, &processAPIKey, "")
+
+	// The fake accepts the tokens below, each issued for the audience it
+	// maps to.
+	issued := map[string]string{
+		"valid-token":          audience,
+		"other-audience-token": "https://elsewhere.example.com",
+	}
+	setForTest(t, &validateIDToken, func(ctx context.Context, token, aud string) (*idtoken.Payload, error) {
+		got, ok := issued[token]
+		if !ok {
+			return nil, errors.New("invalid token")
+		}
+		if got != aud {
+			return nil, fmt.Errorf("audience %q, want %q", got, aud)
+		}
+		return &idtoken.Payload{Audience: got}, nil
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		code          int
+	}{
+		{"valid token", "Bearer valid-token", http.StatusOK},
+		{"missing token", "", http.StatusUnauthorized},
+		{"empty bearer token", "Bearer ", http.StatusUnauthorized},
+		{"not a bearer token", "Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		{"wrong audience", "Bearer other-audience-token", http.StatusUnauthorized},
+		{"unknown token", "Bearer forged-token", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.authorization != "" {
+				header.Set("Authorization", tt.authorization)
+			}
+			called := false
+			next := func(w http.ResponseWriter, r *http.Request) { called = true }
+
+			w := serve(requireAuth(next), http.MethodPost, "/process", header)
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d", w.Code, tt.code)
+			}
+			if called != (tt.code == http.StatusOK) {
+				t.Errorf("next called = %v, want %v", called, tt.code == http.StatusOK)
+			}
+			if tt.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestRequireAuthAPIKey(t *testing.T) {
+	const (
+		audience = "https://podcast-processor.example.com/process"
+		key      = "s3cret-key"
+	)
+	setForTest(t, &validateIDToken, func(ctx context.Context, token, aud string) (*idtoken.Payload, error) {
+		if token != "valid-token" || aud != audience {
+			return nil, errors.New("invalid token")
+		}
+		return &idtoken.Payload{Audience: aud}, nil
+	})
+
+	tests := []struct {
+		name     string
+		audience string // processAudience
+		apiKey   string // processAPIKey
+		header   http.Header
+		code     int
+	}{
+		{"valid key", "", key, http.Header{"X-Api-Key": {key}}, http.StatusOK},
+		{"invalid key", "", key, http.Header{"X-Api-Key": {"guess"}}, http.StatusUnauthorized},
+		{"missing key", "", key, nil, http.StatusUnauthorized},
+		{"token when only a key is configured", "", key, http.Header{"Authorization": {"Bearer valid-token"}}, http.StatusUnauthorized},
+		{"valid key with a token configured", audience, key, http.Header{"X-Api-Key": {key}}, http.StatusOK},
+		{"invalid key with a valid token", audience, key, http.Header{"X-Api-Key": {"guess"}, "Authorization": {"Bearer valid-token"}}, http.StatusUnauthorized},
+		{"valid token with a key configured", audience, key, http.Header{"Authorization": {"Bearer valid-token"}}, http.StatusOK},
+		{"key when no key is configured", audience, "", http.Header{"X-Api-Key": {key}}, http.StatusUnauthorized},
+		{"nothing configured", "", "", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setForTest(t, &processAudience, tt.audience)
+			setForTest(t, &processAPIKey, tt.apiKey)
+			called := false
+			next := func(w http.ResponseWriter, r *http.Request) { called = true }
+
+			w := serve(requireAuth(next), http.MethodPost, "/process", tt.header)
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d", w.Code, tt.code)
+			}
+			if called != (tt.code == http.StatusOK) {
+				t.Errorf("next called = %v, want %v", called, tt.code == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	index, _ := useFakeStores(t)
+	putTestFeed(t, index, testItem(1))
+	router := newRouter()
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		code   int
+		cors   bool
+	}{
+		{"feed", http.MethodGet, "/feed", http.StatusOK, true},
+		{"feed preflight", http.MethodOptions, "/feed", http.StatusNoContent, true},
+		{"index.xml", http.MethodGet, "/index.xml", http.StatusOK, true},
+		{"file preflight", http.MethodOptions, "/files/ep1.mp3", http.StatusNoContent, true},
+		{"process", http.MethodPost, "/process", http.StatusBadRequest, false},
+		{"process preflight", http.MethodOptions, "/process", http.StatusMethodNotAllowed, false},
+		{"health", http.MethodGet, "/health", http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader("{}"))
+			r.Header.Set("Origin", "https://player.example.com")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			origin := w.Header().Get("Access-Control-Allow-Origin")
+			if tt.cors && origin != "*" {
+				t.Errorf("Access-Control-Allow-Origin = %q, want *", origin)
+			}
+			if !tt.cors && origin != "" {
+				t.Errorf("Access-Control-Allow-Origin = %q, want none", origin)
+			}
+			if tt.code == http.StatusNoContent {
+				if methods := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(methods, http.MethodGet) {
+					t.Errorf("Access-Control-Allow-Methods = %q, want GET allowed", methods)
+				}
+				if w.Body.Len() != 0 {
+					t.Errorf("preflight response has a %d-byte body", w.Body.Len())
+				}
+			}
+		})
+	}
+}
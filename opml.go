@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+)
+
+// OPML is an OPML 2.0 subscription list.
+type OPML struct {
+	XMLName xml.Name    `xml:"opml"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"head>title"`
+	Outline []OPMLEntry `xml:"body>outline"`
+}
+
+// OPMLEntry is one feed in an OPML subscription list.
+type OPMLEntry struct {
+	Type    string `xml:"type,attr"`
+	Text    string `xml:"text,attr"`
+	Title   string `xml:"title,attr"`
+	XMLURL  string `xml:"xmlUrl,attr"`
+	HTMLURL string `xml:"htmlUrl,attr,omitempty"`
+}
+
+// opmlHandler lists every show's feed as an OPML document, so listeners can
+// subscribe to all of them at once.
+func opmlHandler(w http.ResponseWriter, r *http.Request) {
+	doc := OPML{Version: "2.0", Title: feedTitle}
+	for _, show := range shows {
+		doc.Outline = append(doc.Outline, OPMLEntry{
+			Type:    "rss",
+			Text:    show.Title,
+			Title:   show.Title,
+			XMLURL:  show.FeedURL,
+			HTMLURL: feedLink,
+		})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		logger.Error("Error encoding OPML", "error", err)
+		writeError(w, http.StatusInternalServerError, "opml_encode_failed", "Failed to encode OPML")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	buf.WriteTo(w)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"testing"
+)
+
+func TestOPMLHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		shows   string
+		xmlURLs []string
+	}{
+		{"single show", "", []string{publicFeedURL}},
+		{"several shows", "news,tech", []string{publicFeedURL + "/news", publicFeedURL + "/tech"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setForTest(t, &shows, loadShows(tt.shows))
+
+			w := serve(opmlHandler, http.MethodGet, "/feeds.opml", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+
+			var doc OPML
+			if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+				t.Fatalf("response isn't OPML: %v\n%s", err, w.Body)
+			}
+			if doc.Version != "2.0" {
+				t.Errorf("version = %q, want 2.0", doc.Version)
+			}
+			if len(doc.Outline) != len(tt.xmlURLs) {
+				t.Fatalf("%d outlines, want %d", len(doc.Outline), len(tt.xmlURLs))
+			}
+			for i, o := range doc.Outline {
+				if o.Type != "rss" || o.XMLURL != tt.xmlURLs[i] || o.Title != shows[i].Title {
+					t.Errorf("outline %d = %+v, want an rss outline titled %q for %s", i, o, shows[i].Title, tt.xmlURLs[i])
+				}
+			}
+		})
+	}
+}
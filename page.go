@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// indexPage lists the episodes of a feed for people browsing to / rather
+// than subscribing.
+var indexPage = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html lang="{{.Channel.Language}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Channel.Title}}</title>
+<link rel="alternate" type="application/rss+xml" title="{{.Channel.Title}}" href="{{.FeedURL}}">
+</head>
+<body>
+<h1>{{.Channel.Title}}</h1>
+{{with .Channel.Description}}<p>{{.}}</p>{{end}}
+<p><a href="{{.FeedURL}}">Subscribe to the RSS feed</a></p>
+<ul>
+{{- range .Channel.Items}}
+<li>
+<a href="{{.Enclosure.URL}}">{{.Title}}</a>
+{{with .PubDate}}<time>{{.}}</time>{{end}}
+{{with .ITunesDuration}}({{.}}){{end}}
+</li>
+{{- else}}
+<li>No episodes yet.</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+// indexPageHandler renders the default show's episodes as an HTML page.
+func indexPageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := readContext(r.Context())
+	defer cancel()
+
+	show := shows[0]
+	index, err := getIndexXML(ctx, show)
+	if err != nil {
+		logger.Error("Error fetching index.xml", "error", err)
+		writeError(w, http.StatusInternalServerError, "feed_read_failed", "Failed to fetch index.xml")
+		return
+	}
+
+	feed, err := parseFeed(index.Content)
+	if err != nil {
+		logger.Error("Error parsing index.xml", "error", err)
+		writeError(w, http.StatusInternalServerError, "feed_parse_failed", "Failed to parse index.xml")
+		return
+	}
+
+	var buf bytes.Buffer
+	err = indexPage.Execute(&buf, struct {
+		Channel Channel
+		FeedURL string
+	}{feed.Channel, show.FeedURL})
+	if err != nil {
+		logger.Error("Error rendering index page", "error", err)
+		writeError(w, http.StatusInternalServerError, "page_render_failed", "Failed to render page")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	buf.WriteTo(w)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIndexPageHandler(t *testing.T) {
+	index, _ := useFakeStores(t)
+	tricky := testItem(2)
+	tricky.Title = "Q&A <live>"
+	putTestFeed(t, index, testItem(1), tricky)
+
+	w := serve(indexPageHandler, http.MethodGet, "/", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/html", ct)
+	}
+
+	page := w.Body.String()
+	for _, want := range []string{
+		`<a href="` + fileURL("ep1.mp3") + `">Episode 1</a>`,
+		`/files/ep2.mp3">`,
+		">Q&amp;A &lt;live&gt;</a>",
+		"<time>Wed, 01 May 2024 13:00:00 &#43;0000</time>",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page doesn't contain %q:\n%s", want, page)
+		}
+	}
+}
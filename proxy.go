@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/joshlavin/podcast-processor/internal/episode"
+)
+
+// proxyFile streams an object from the files bucket to the client, honouring
+// a single-range Range header so players can seek. Ranges that lie entirely
+// past the end of the object get 416. Objects larger than MAX_PROXY_SIZE are
+// redirected to a signed URL instead.
+func proxyFile(w http.ResponseWriter, r *http.Request, name string) {
+	// Streaming a long episode can take far longer than READ_TIMEOUT.
+	ctx, cancel := context.WithTimeout(r.Context(), processTimeout)
+	defer cancel()
+
+	attrs, err := filesStore.Attrs(ctx, name)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		writeError(w, http.StatusNotFound, "file_not_found", "File not found")
+		return
+	}
+	if err != nil {
+		logger.Error("Error reading file attributes", "object", name, "error", err)
+		writeError(w, http.StatusInternalServerError, "file_read_failed", "Failed to read podcast file")
+		return
+	}
+
+	// Streaming a very large file would tie up the instance; let GCS serve it.
+	if maxProxySize > 0 && attrs.Size > int64(maxProxySize) {
+		redirectToSignedURL(w, r, attrs)
+		return
+	}
+
+	offset, length, partial, err := parseRange(r.Header.Get("Range"), attrs.Size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", attrs.Size))
+		writeError(w, http.StatusRequestedRangeNotSatisfiable, "range_not_satisfiable", "Requested range not satisfiable")
+		return
+	}
+
+	reader, err := filesStore.NewRangeReader(ctx, name, offset, length)
+	if err != nil {
+		logger.Error("Error opening file", "object", name, "error", err)
+		writeError(w, http.StatusInternalServerError, "file_read_failed", "Failed to read podcast file")
+		return
+	}
+	defer reader.Close()
+
+	contentType := attrs.ContentType
+	if contentType == "" {
+		contentType = episode.MIMEType(name)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	// The stored bytes are sent as they are, so the client does any
+	// decompression.
+	if attrs.ContentEncoding != "" {
+		h.Set("Content-Encoding", attrs.ContentEncoding)
+	}
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("ETag", fmt.Sprintf(`"%d"`, attrs.Generation))
+	h.Set("Last-Modified", attrs.Updated.UTC().Format(http.TimeFormat))
+
+	status := http.StatusOK
+	if partial {
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, attrs.Size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		logger.Warn("Error streaming file", "object", name, "error", err)
+	}
+}
+
+// errUnsatisfiableRange is returned by parseRange when no part of the
+// requested range lies within the object.
+var errUnsatisfiableRange = errors.New("range not satisfiable")
+
+// parseRange returns the offset and length to serve for a Range header on an
+// object of the given size. A single "bytes=start-", "bytes=start-end" or
+// suffix "bytes=-n" range is supported. Headers that are malformed or ask for
+// several ranges are ignored and the whole object is served with partial set
+// to false, as RFC 9110 allows.
+func parseRange(header string, size int64) (offset, length int64, partial bool, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size, false, nil
+	}
+
+	startStr, endStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size, false, nil
+	}
+
+	if startStr == "" {
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n < 0 {
+			return 0, size, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errUnsatisfiableRange
+		}
+		n = min(n, size)
+		return size - n, n, true, nil
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, false, nil
+	}
+	end := size - 1
+	if endStr != "" {
+		e, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || e < start {
+			return 0, size, false, nil
+		}
+		end = min(e, size-1)
+	}
+	if start >= size {
+		return 0, 0, false, errUnsatisfiableRange
+	}
+	return start, end - start + 1, true, nil
+}
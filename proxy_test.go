@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	const size = 1000
+	tests := []struct {
+		header  string
+		offset  int64
+		length  int64
+		partial bool
+		err     error
+	}{
+		{"", 0, size, false, nil},
+		{"bytes=0-", 0, size, true, nil},
+		{"bytes=100-199", 100, 100, true, nil},
+		{"bytes=900-1999", 900, 100, true, nil},
+		{"bytes=999-999", 999, 1, true, nil},
+		{"bytes=-100", 900, 100, true, nil},
+		{"bytes=-5000", 0, size, true, nil},
+		{"bytes=1000-", 0, 0, false, errUnsatisfiableRange},
+		{"bytes=5000-5999", 0, 0, false, errUnsatisfiableRange},
+		{"bytes=-0", 0, 0, false, errUnsatisfiableRange},
+		{"bytes=199-100", 0, size, false, nil},
+		{"bytes=0-1,5-6", 0, size, false, nil},
+		{"bytes=a-b", 0, size, false, nil},
+		{"items=0-99", 0, size, false, nil},
+	}
+	for _, tt := range tests {
+		offset, length, partial, err := parseRange(tt.header, size)
+		if offset != tt.offset || length != tt.length || partial != tt.partial || !errors.Is(err, tt.err) {
+			t.Errorf("parseRange(%q) = %d, %d, %v, %v, want %d, %d, %v, %v",
+				tt.header, offset, length, partial, err, tt.offset, tt.length, tt.partial, tt.err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Show is one podcast served by this deployment. Each show has its own
+// index.xml, and its episodes live under their own prefix of the files
+// bucket.
+type Show struct {
+	Name        string // "" for the single show used when SHOWS is unset
+	Title       string
+	Prefix      string // files bucket prefix holding the show's episodes
+	IndexObject string
+	FeedURL     string
+
+	// Cached copy of IndexObject, guarded by cacheMutex.
+	cached    *indexXML
+	cacheTime time.Time
+}
+
+// shows are the shows this deployment serves. SHOWS is a comma-separated
+// list of names; episodes of show "news" live under FILES_PREFIX + "news/",
+// its feed is written to news/index.xml and served at /feed/news. When SHOWS
+// is unset there is a single show covering all of FILES_PREFIX. The first
+// show is also served at /feed, /index.xml and /.
+var shows = loadShows(os.Getenv("SHOWS"))
+
+func loadShows(names string) []*Show {
+	if names == "" {
+		return []*Show{{
+			Title:       feedTitle,
+			Prefix:      filesPrefix,
+			IndexObject: indexObject,
+			FeedURL:     publicFeedURL,
+		}}
+	}
+
+	var list []*Show
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		envName := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		list = append(list, &Show{
+			Name:        name,
+			Title:       getEnv("FEED_TITLE_"+envName, feedTitle+" - "+name),
+			Prefix:      filesPrefix + name + "/",
+			IndexObject: name + "/" + indexObject,
+			FeedURL:     strings.TrimSuffix(publicFeedURL, "/") + "/" + name,
+		})
+	}
+	return list
+}
+
+// validShowName reports whether name can be used as a show name: it becomes
+// a path segment in object names and URLs.
+func validShowName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\?#%`)
+}
+
+// showNamed returns the show called name, or the default show if name is
+// empty. It returns nil if there is no such show.
+func showNamed(name string) *Show {
+	if name == "" {
+		return shows[0]
+	}
+	for _, s := range shows {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// showFor returns the show whose prefix holds objectName, or nil if it
+// belongs to none of them.
+func showFor(objectName string) *Show {
+	for _, s := range shows {
+		if strings.HasPrefix(objectName, s.Prefix) {
+			return s
+		}
+	}
+	return nil
+}
+
+// archiveObject returns the object name of archive page n of the show's
+// feed, e.g. index-2-lq3x9k.xml for version "lq3x9k". Each feed write
+// stores its archive pages under a new version, so index.xml only ever links
+// to a complete set. Version "" names the unversioned pages, e.g.
+// index-2.xml, written before archive pages had versions.
+func (s *Show) archiveObject(n int, version string) string {
+	ext := filepath.Ext(s.IndexObject)
+	base := fmt.Sprintf("%s-%d", strings.TrimSuffix(s.IndexObject, ext), n)
+	if version != "" {
+		base += "-" + version
+	}
+	return base + ext
+}
+
+// pageURL returns the public URL of page n of the show's feed, where archive
+// pages are those of the given version.
+func (s *Show) pageURL(n int, version string) string {
+	if n == 1 {
+		return s.FeedURL
+	}
+	u := fmt.Sprintf("%s?page=%d", s.FeedURL, n)
+	if version != "" {
+		u += "&v=" + url.QueryEscape(version)
+	}
+	return u
+}
+
+// newArchiveVersion returns a version for the archive pages of a feed write
+// that no other write uses.
+func newArchiveVersion() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// nextArchiveVersion returns the version of the archive page that the
+// channel's rel="next" atom:link points at, and false if it has none.
+func nextArchiveVersion(c *Channel) (string, bool) {
+	for _, link := range c.AtomLinks {
+		if link.Rel != "next" {
+			continue
+		}
+		u, err := url.Parse(link.Href)
+		if err != nil {
+			return "", true
+		}
+		return u.Query().Get("v"), true
+	}
+	return "", false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// feedStats summarises a feed for operators.
+type feedStats struct {
+	Episodes     int    `json:"episodes"`
+	TotalBytes   int64  `json:"total_bytes"`
+	Newest       string `json:"newest,omitempty"`
+	Oldest       string `json:"oldest,omitempty"`
+	Generation   int64  `json:"generation"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// statsFor summarises feed, read from index.
+func statsFor(feed *RSS, index *indexXML) feedStats {
+	stats := feedStats{
+		Episodes:   len(feed.Channel.Items),
+		Generation: index.Generation,
+	}
+	if !index.Updated.IsZero() {
+		stats.LastModified = index.Updated.UTC().Format(time.RFC3339)
+	}
+
+	var newest, oldest time.Time
+	for _, item := range feed.Channel.Items {
+		stats.TotalBytes += item.Enclosure.Length
+		t := item.pubTime()
+		if t.IsZero() {
+			continue
+		}
+		if newest.IsZero() || t.After(newest) {
+			newest = t
+		}
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	if !newest.IsZero() {
+		stats.Newest = newest.UTC().Format(time.RFC3339)
+		stats.Oldest = oldest.UTC().Format(time.RFC3339)
+	}
+	return stats
+}
+
+// statsHandler reports episode count, total size and date range of a show's
+// feed as JSON. The show is chosen with ?show=, defaulting to the first.
+// Only index.xml is counted, not archive pages.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	show := showNamed(r.URL.Query().Get("show"))
+	if show == nil {
+		notFoundHandler(w, r)
+		return
+	}
+
+	ctx, cancel := readContext(r.Context())
+	defer cancel()
+
+	index, err := getIndexXML(ctx, show)
+	if err != nil {
+		logger.Error("Error fetching index.xml", "error", err)
+		writeError(w, http.StatusInternalServerError, "feed_read_failed", "Failed to fetch podcast feed")
+		return
+	}
+
+	feed, err := parseFeed(index.Content)
+	if err != nil {
+		logger.Error("Error parsing index.xml", "error", err)
+		writeError(w, http.StatusInternalServerError, "feed_parse_failed", "Failed to parse podcast feed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statsFor(feed, index))
+}
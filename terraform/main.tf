@@ -20,6 +20,14 @@ data "google_project" "current" {
   project_id = var.project_id
 }
 
+locals {
+  # The service's deterministic run.app URL, which is the audience of the
+  # OIDC tokens Eventarc sends to /process. It can't be read from the
+  # service's own status without a dependency cycle.
+  service_url      = "https://${var.service_name}-${data.google_project.current.number}.${var.region}.run.app"
+  process_audience = var.process_audience != "" ? var.process_audience : local.service_url
+}
+
 # Service Account
 resource "google_service_account" "podcast_processor" {
   account_id   = var.service_account_name
@@ -144,6 +152,13 @@ resource "google_cloud_run_service" "podcast_processor" {
           value = var.index_object_name
         }
 
+        # /process, /rebuild and /admin/reindex require an OIDC token for
+        # this audience; the service won't start without it.
+        env {
+          name  = "PROCESS_AUDIENCE"
+          value = local.process_audience
+        }
+
         resources {
           limits = {
             memory = "512Mi"
@@ -46,3 +46,9 @@ variable "index_object_name" {
   type        = string
   default     = "index.xml"
 }
+
+variable "process_audience" {
+  description = "Audience of the OIDC tokens accepted by /process, /rebuild and /admin/reindex. Defaults to the service's https://SERVICE-PROJECT_NUMBER.REGION.run.app URL"
+  type        = string
+  default     = ""
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// notifyHub tells the WEBSUB_HUB hub that the feed at feedURL has changed, so
+// it can push the update to subscribers. It does nothing if no hub is
+// configured.
+func notifyHub(ctx context.Context, feedURL string) error {
+	if websubHub == "" {
+		return nil
+	}
+
+	form := url.Values{"hub.mode": {"publish"}, "hub.url": {feedURL}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, websubHub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create hub request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to ping hub: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("hub returned %s", resp.Status)
+	}
+	return nil
+}